@@ -2,11 +2,16 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/asdine/storm"
 	"github.com/asdine/storm/q"
 	"github.com/gorilla/mux"
+	"github.com/resin-io/edge-node-manager/application/rollout"
 	"github.com/resin-io/edge-node-manager/config"
 	"github.com/resin-io/edge-node-manager/device"
 	"github.com/resin-io/edge-node-manager/process"
@@ -17,8 +22,9 @@ import (
 
 func DependentDeviceUpdate(w http.ResponseWriter, r *http.Request) {
 	type dependentDeviceUpdate struct {
-		Commit      string      `json:"commit"`
-		Environment interface{} `json:"environment"`
+		Commit      string                 `json:"commit"`
+		Environment map[string]interface{} `json:"environment"`
+		Config      map[string]interface{} `json:"config"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -31,29 +37,186 @@ func DependentDeviceUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := setField(r, "TargetCommit", content.Commit); err != nil {
+	fields := map[string]interface{}{
+		"TargetCommit": content.Commit,
+	}
+
+	// Only overwrite the target environment and config if the supervisor sent them
+	if content.Environment != nil {
+		fields["TargetEnvironment"] = content.Environment
+	}
+	if content.Config != nil {
+		fields["TargetConfig"] = content.Config
+	}
+
+	d, err := setFields(r, fields)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// Start downloading the firmware before the device is processed
+	process.Prefetch(d.ApplicationUUID, d.TargetCommit)
+
+	enqueue(d, "Update")
+
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func DependentDeviceDelete(w http.ResponseWriter, r *http.Request) {
-	if err := setField(r, "Delete", true); err != nil {
+	d, err := setField(r, "Delete", true)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	enqueue(d, "Delete")
+
 	w.WriteHeader(http.StatusOK)
 }
 
 func DependentDeviceRestart(w http.ResponseWriter, r *http.Request) {
-	if err := setField(r, "Restart", true); err != nil {
+	d, err := setField(r, "Restart", true)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	enqueue(d, "Restart")
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func DependentDeviceIdentify(w http.ResponseWriter, r *http.Request) {
+	type dependentDeviceIdentify struct {
+		Duration int `json:"duration"`
+	}
+
+	// The body is optional so ignore an empty one
+	decoder := json.NewDecoder(r.Body)
+	var content dependentDeviceIdentify
+	if err := decoder.Decode(&content); err != nil && err != io.EOF {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to decode Dependent device identify hook")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	duration := (time.Duration)(content.Duration) * time.Second
+	if duration <= 0 {
+		var err error
+		if duration, err = config.GetIdentifyDuration(); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Error("Unable to load identify duration")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	d, err := setFields(r, map[string]interface{}{
+		"Identify":         true,
+		"IdentifyDuration": duration,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	enqueue(d, "Identify")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func DependentDeviceUpdateRetry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	UUID := vars["uuid"]
+
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var d device.Device
+	err = db.Select(
+		q.Or(
+			q.Eq("LocalUUID", UUID),
+			q.Eq("ResinUUID", UUID),
+		),
+	).First(&d)
+	db.Close()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to find device in database")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	retried, err := process.RetryUpdate(d)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to retry update")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !retried {
+		// The device has no failed update to retry
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	enqueue(d, "Retry update")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func DecommissionedDeviceDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	UUID := vars["uuid"]
+
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var tombstone device.Tombstone
+	if err := db.Select(
+		q.Or(
+			q.Eq("LocalUUID", UUID),
+			q.Eq("ResinUUID", UUID),
+		),
+	).First(&tombstone); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to find decommissioned device in database")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.DeleteStruct(&tombstone); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to delete decommissioned device from database")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Name":       tombstone.Name,
+		"Local UUID": tombstone.LocalUUID,
+	}).Info("Decommissioned device forgotten")
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -144,6 +307,153 @@ func DependentDeviceQuery(w http.ResponseWriter, r *http.Request) {
 	}).Debug("Get dependent device")
 }
 
+func DependentDeviceUpdateProgress(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	UUID := vars["uuid"]
+
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var d device.Device
+	err = db.Select(
+		q.Or(
+			q.Eq("LocalUUID", UUID),
+			q.Eq("ResinUUID", UUID),
+		),
+	).First(&d)
+	db.Close()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to find device in database")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	progress, err := process.GetUpdateProgress(d)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to get update progress")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(progress)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to encode update progress")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if written, err := w.Write(bytes); (err != nil) || (written != len(bytes)) {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to write response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Phase":     progress.Phase,
+		"Percent %": progress.Percent,
+	}).Debug("Get dependent device update progress")
+}
+
+func DependentApplicationRollout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	UUID, err := strconv.Atoi(vars["uuid"])
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  vars["uuid"],
+		}).Error("Unable to parse application UUID")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var ro rollout.Rollout
+	if err := db.One("ApplicationUUID", UUID, &ro); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+			"UUID":  UUID,
+		}).Error("Unable to find rollout in database")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(ro)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to encode rollout")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if written, err := w.Write(bytes); (err != nil) || (written != len(bytes)) {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to write response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Rollout": ro,
+	}).Debug("Get dependent application rollout")
+}
+
+func AssetsQuery(w http.ResponseWriter, r *http.Request) {
+	usage, err := process.AssetsUsage()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to get assets usage")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(usage)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to encode assets usage")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if written, err := w.Write(bytes); (err != nil) || (written != len(bytes)) {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to write response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Size":     usage.Size,
+		"Max size": usage.MaxSize,
+	}).Debug("Get assets usage")
+}
+
 func SetStatus(w http.ResponseWriter, r *http.Request) {
 	type s struct {
 		TargetStatus status.Status `json:"targetStatus"`
@@ -203,40 +513,70 @@ func GetStatus(w http.ResponseWriter, r *http.Request) {
 	}).Debug("Get status")
 }
 
-func setField(r *http.Request, key string, value interface{}) error {
+// enqueue wakes the processor to process the device straight away
+func enqueue(d device.Device, reason string) {
+	process.Enqueue(process.Request{
+		ApplicationUUID: d.ApplicationUUID,
+		ResinUUID:       d.ResinUUID,
+		Reason:          reason,
+	})
+}
+
+func setField(r *http.Request, key string, value interface{}) (device.Device, error) {
+	return setFields(r, map[string]interface{}{key: value})
+}
+
+func setFields(r *http.Request, fields map[string]interface{}) (device.Device, error) {
 	vars := mux.Vars(r)
 	deviceUUID := vars["uuid"]
 
+	var d device.Device
+
 	db, err := storm.Open(config.GetDbPath())
 	if err != nil {
-		return err
+		return d, err
 	}
 	defer db.Close()
 
-	var d device.Device
-	if err := db.One("ResinUUID", deviceUUID, &d); err != nil {
+	if err := db.Select(
+		q.Or(
+			q.Eq("LocalUUID", deviceUUID),
+			q.Eq("ResinUUID", deviceUUID),
+		),
+	).First(&d); err != nil {
 		log.WithFields(log.Fields{
 			"Error": err,
 			"UUID":  deviceUUID,
 		}).Error("Unable to find device in database")
-		return err
+		return d, err
 	}
 
-	switch key {
-	case "TargetCommit":
-		d.TargetCommit = value.(string)
-	case "Delete":
-		d.DeleteFlag = value.(bool)
-	case "Restart":
-		d.RestartFlag = value.(bool)
-	default:
-		log.WithFields(log.Fields{
-			"Error": err,
-			"UUID":  deviceUUID,
-			"Key":   key,
-			"value": value,
-		}).Error("Unable to set field")
-		return err
+	for key, value := range fields {
+		switch key {
+		case "TargetCommit":
+			d.TargetCommit = value.(string)
+		case "TargetConfig":
+			d.TargetConfig = value.(map[string]interface{})
+		case "TargetEnvironment":
+			d.TargetEnvironment = value.(map[string]interface{})
+		case "Delete":
+			d.DeleteFlag = value.(bool)
+		case "Restart":
+			d.RestartFlag = value.(bool)
+		case "Identify":
+			d.IdentifyFlag = value.(bool)
+		case "IdentifyDuration":
+			d.IdentifyDuration = value.(time.Duration)
+		default:
+			err := fmt.Errorf("Unknown field")
+			log.WithFields(log.Fields{
+				"Error": err,
+				"UUID":  deviceUUID,
+				"Key":   key,
+				"value": value,
+			}).Error("Unable to set field")
+			return d, err
+		}
 	}
 
 	if err := db.Update(&d); err != nil {
@@ -244,14 +584,13 @@ func setField(r *http.Request, key string, value interface{}) error {
 			"Error": err,
 			"UUID":  deviceUUID,
 		}).Error("Unable to update device in database")
-		return err
+		return d, err
 	}
 
 	log.WithFields(log.Fields{
-		"UUID":  deviceUUID,
-		"Key":   key,
-		"value": value,
-	}).Debug("Dependent device field updated")
+		"UUID":   deviceUUID,
+		"Fields": fields,
+	}).Debug("Dependent device fields updated")
 
-	return nil
+	return d, nil
 }
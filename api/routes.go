@@ -32,6 +32,30 @@ var routes = Routes{
 		"/v1/devices/{uuid}/restart",
 		DependentDeviceRestart,
 	},
+	Route{
+		"DependentDeviceIdentify",
+		"POST",
+		"/v1/devices/{uuid}/identify",
+		DependentDeviceIdentify,
+	},
+	Route{
+		"DependentDeviceUpdateRetry",
+		"POST",
+		"/v1/devices/{uuid}/update/retry",
+		DependentDeviceUpdateRetry,
+	},
+	Route{
+		"DependentDeviceUpdateProgress",
+		"GET",
+		"/v1/devices/{uuid}/update",
+		DependentDeviceUpdateProgress,
+	},
+	Route{
+		"DecommissionedDeviceDelete",
+		"DELETE",
+		"/v1/decommissioned/{uuid}",
+		DecommissionedDeviceDelete,
+	},
 	Route{
 		"DependentDevicesQuery",
 		"GET",
@@ -44,6 +68,18 @@ var routes = Routes{
 		"/v1/devices/{uuid}",
 		DependentDeviceQuery,
 	},
+	Route{
+		"DependentApplicationRollout",
+		"GET",
+		"/v1/applications/{uuid}/rollout",
+		DependentApplicationRollout,
+	},
+	Route{
+		"AssetsQuery",
+		"GET",
+		"/v1/assets",
+		AssetsQuery,
+	},
 	Route{
 		"SetStatus",
 		"PUT",
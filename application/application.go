@@ -8,6 +8,7 @@ import (
 	"github.com/resin-io/edge-node-manager/board/esp8266"
 	"github.com/resin-io/edge-node-manager/board/microbit"
 	"github.com/resin-io/edge-node-manager/board/nrf51822dk"
+	"github.com/resin-io/edge-node-manager/board/nrf52dk"
 )
 
 type Application struct {
@@ -57,6 +58,8 @@ func Unmarshal(bytes []byte) (map[int]Application, error) {
 			b = microbit.Microbit{}
 		case board.NRF51822DK:
 			b = nrf51822dk.Nrf51822dk{}
+		case board.NRF52DK:
+			b = nrf52dk.Nrf52dk{}
 		case board.ESP8266:
 			b = esp8266.Esp8266{}
 		default:
@@ -0,0 +1,238 @@
+package rollout
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+// Application config keys used to set the rollout policy
+const (
+	canariesKey         = "ENM_ROLLOUT_CANARIES"
+	batchPercentKey     = "ENM_ROLLOUT_BATCH_PERCENT"
+	soakTimeKey         = "ENM_ROLLOUT_SOAK_TIME"
+	failureThresholdKey = "ENM_ROLLOUT_FAILURE_THRESHOLD"
+)
+
+// Policy defines how an update is rolled out to an application's devices
+// The defaults update every device at once and never halt
+type Policy struct {
+	Canaries         int
+	BatchPercent     int
+	SoakTime         time.Duration
+	FailureThreshold int
+}
+
+// Rollout records the progress of an application's update to its target commit
+// Devices are admitted in stages, first the canaries then a batch at a time, and the next stage
+// is only started once every admitted device has been updated and the soak time has passed
+type Rollout struct {
+	ApplicationUUID int `storm:"id,unique,index"`
+	TargetCommit    string
+	Policy          Policy
+	Stage           int
+	Fleet           int
+	Admitted        []string
+	Succeeded       []string
+	Failed          []string
+	Failures        map[failure.Category]int
+	SoakUntil       time.Time
+	Halted          bool
+	HaltReason      string
+	Started         time.Time
+	Updated         time.Time
+}
+
+func (r Rollout) String() string {
+	return fmt.Sprintf(
+		"Application UUID: %d, "+
+			"Target commit: %s, "+
+			"Stage: %d, "+
+			"Fleet: %d, "+
+			"Admitted: %d, "+
+			"Succeeded: %d, "+
+			"Failed: %d, "+
+			"Halted: %t",
+		r.ApplicationUUID,
+		r.TargetCommit,
+		r.Stage,
+		r.Fleet,
+		len(r.Admitted),
+		len(r.Succeeded),
+		len(r.Failed),
+		r.Halted)
+}
+
+// GetPolicy reads the rollout policy from the application config
+func GetPolicy(config map[string]interface{}) (Policy, error) {
+	var policy Policy
+	var err error
+
+	if policy.Canaries, err = getInt(config, canariesKey, 0, 0, -1); err != nil {
+		return policy, err
+	}
+
+	if policy.BatchPercent, err = getInt(config, batchPercentKey, 100, 1, 100); err != nil {
+		return policy, err
+	}
+
+	soakTime, err := getInt(config, soakTimeKey, 0, 0, -1)
+	if err != nil {
+		return policy, err
+	}
+	policy.SoakTime = time.Duration(soakTime) * time.Second
+
+	if policy.FailureThreshold, err = getInt(config, failureThresholdKey, 100, 0, 100); err != nil {
+		return policy, err
+	}
+
+	return policy, nil
+}
+
+func New(applicationUUID int, targetCommit string, policy Policy) Rollout {
+	stage := 1
+	if policy.Canaries > 0 {
+		stage = 0
+	}
+
+	return Rollout{
+		ApplicationUUID: applicationUUID,
+		TargetCommit:    targetCommit,
+		Policy:          policy,
+		Stage:           stage,
+		Started:         time.Now(),
+		Updated:         time.Now(),
+	}
+}
+
+// Allowed returns the number of devices which may be admitted by the current stage
+func (r Rollout) Allowed() int {
+	allowed := r.Policy.Canaries
+	if r.Stage > 0 {
+		batch := (r.Fleet*r.Policy.BatchPercent + 99) / 100
+		if batch < 1 {
+			batch = 1
+		}
+		allowed += r.Stage * batch
+	}
+
+	if allowed > r.Fleet {
+		allowed = r.Fleet
+	}
+
+	return allowed
+}
+
+// Admit returns true if the device may be updated, admitting it to the current stage if there is room
+// Devices which have already been admitted may always be updated, no new devices are admitted once halted
+func (r *Rollout) Admit(resinUUID string) bool {
+	if contains(r.Admitted, resinUUID) {
+		return true
+	}
+
+	if r.Halted || len(r.Admitted) >= r.Allowed() {
+		return false
+	}
+
+	r.Admitted = append(r.Admitted, resinUUID)
+	return true
+}
+
+// Withdraw removes a device which was admitted but not updated, freeing its place in the stage
+func (r *Rollout) Withdraw(resinUUID string) {
+	r.Admitted = remove(r.Admitted, resinUUID)
+	r.Succeeded = remove(r.Succeeded, resinUUID)
+	r.Failed = remove(r.Failed, resinUUID)
+}
+
+// Record records the result of updating a device and halts the rollout if the failure threshold is crossed
+func (r *Rollout) Record(resinUUID string, success bool) {
+	r.Succeeded = remove(r.Succeeded, resinUUID)
+	r.Failed = remove(r.Failed, resinUUID)
+
+	if success {
+		r.Succeeded = append(r.Succeeded, resinUUID)
+	} else {
+		r.Failed = append(r.Failed, resinUUID)
+	}
+
+	if r.Halted || len(r.Admitted) == 0 {
+		return
+	}
+
+	if ratio := len(r.Failed) * 100 / len(r.Admitted); ratio > r.Policy.FailureThreshold {
+		r.Halted = true
+		r.HaltReason = fmt.Sprintf("%d%% of updates failed, exceeding the %d%% threshold", ratio, r.Policy.FailureThreshold)
+	}
+}
+
+// CountFailure counts a failed update by its category
+func (r *Rollout) CountFailure(category failure.Category) {
+	if r.Failures == nil {
+		r.Failures = make(map[failure.Category]int)
+	}
+	r.Failures[category]++
+}
+
+// Advance moves on to the next stage once the current stage is full, settled and has soaked
+func (r *Rollout) Advance(now time.Time) {
+	if r.Halted || r.Allowed() >= r.Fleet || len(r.Admitted) < r.Allowed() {
+		return
+	}
+
+	if len(r.Succeeded)+len(r.Failed) < len(r.Admitted) {
+		return
+	}
+
+	if r.SoakUntil.IsZero() {
+		r.SoakUntil = now.Add(r.Policy.SoakTime)
+	}
+
+	if now.Before(r.SoakUntil) {
+		return
+	}
+
+	r.Stage++
+	r.SoakUntil = time.Time{}
+}
+
+func getInt(config map[string]interface{}, key string, def, min, max int) (int, error) {
+	raw, ok := config[key]
+	if !ok || raw == nil {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(fmt.Sprint(raw))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %v", key, raw)
+	}
+
+	if value < min || (max >= 0 && value > max) {
+		return 0, fmt.Errorf("%s out of range: %d", key, value)
+	}
+
+	return value, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func remove(list []string, value string) []string {
+	var result []string
+	for _, item := range list {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,182 @@
+package rollout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmit(t *testing.T) {
+	staged := Policy{Canaries: 2, BatchPercent: 50, FailureThreshold: 100}
+
+	tests := []struct {
+		name     string
+		rollout  Rollout
+		device   string
+		admitted bool
+	}{
+		{"room in canaries", Rollout{Policy: staged, Stage: 0, Fleet: 10, Admitted: []string{"a"}}, "b", true},
+		{"canaries full", Rollout{Policy: staged, Stage: 0, Fleet: 10, Admitted: []string{"a", "b"}}, "c", false},
+		{"already admitted", Rollout{Policy: staged, Stage: 0, Fleet: 10, Admitted: []string{"a", "b"}}, "a", true},
+		{"room in batch", Rollout{Policy: staged, Stage: 1, Fleet: 10, Admitted: []string{"a", "b", "c", "d", "e", "f"}}, "g", true},
+		{"batch full", Rollout{Policy: staged, Stage: 1, Fleet: 10, Admitted: []string{"a", "b", "c", "d", "e", "f", "g"}}, "h", false},
+		{"halted", Rollout{Policy: staged, Stage: 1, Fleet: 10, Admitted: []string{"a"}, Halted: true}, "b", false},
+		{"halted already admitted", Rollout{Policy: staged, Stage: 1, Fleet: 10, Admitted: []string{"a"}, Halted: true}, "a", true},
+		{"no policy", Rollout{Policy: Policy{BatchPercent: 100, FailureThreshold: 100}, Stage: 1, Fleet: 3, Admitted: []string{"a", "b"}}, "c", true},
+		{"whole fleet admitted", Rollout{Policy: Policy{BatchPercent: 100, FailureThreshold: 100}, Stage: 1, Fleet: 2, Admitted: []string{"a", "b"}}, "c", false},
+		{"batch of at least one", Rollout{Policy: Policy{BatchPercent: 1, FailureThreshold: 100}, Stage: 1, Fleet: 10}, "a", true},
+	}
+
+	for _, test := range tests {
+		admitted := test.rollout.Admit(test.device)
+		if admitted != test.admitted {
+			t.Errorf("%s: Admit(%s) = %t, expected %t", test.name, test.device, admitted, test.admitted)
+		}
+
+		if contains(test.rollout.Admitted, test.device) != test.admitted {
+			t.Errorf("%s: Admit(%s) admitted %v", test.name, test.device, test.rollout.Admitted)
+		}
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	now := time.Date(2018, time.April, 9, 12, 0, 0, 0, time.UTC)
+	policy := Policy{Canaries: 1, BatchPercent: 50, SoakTime: time.Hour, FailureThreshold: 100}
+
+	tests := []struct {
+		name      string
+		rollout   Rollout
+		stage     int
+		soakUntil time.Time
+	}{
+		{
+			"stage not full",
+			Rollout{Policy: policy, Stage: 0, Fleet: 4},
+			0, time.Time{},
+		},
+		{
+			"stage not settled",
+			Rollout{Policy: policy, Stage: 0, Fleet: 4, Admitted: []string{"a"}},
+			0, time.Time{},
+		},
+		{
+			"stage settled starts soaking",
+			Rollout{Policy: policy, Stage: 0, Fleet: 4, Admitted: []string{"a"}, Succeeded: []string{"a"}},
+			0, now.Add(time.Hour),
+		},
+		{
+			"stage soaking",
+			Rollout{Policy: policy, Stage: 0, Fleet: 4, Admitted: []string{"a"}, Succeeded: []string{"a"}, SoakUntil: now.Add(time.Minute)},
+			0, now.Add(time.Minute),
+		},
+		{
+			"stage soaked",
+			Rollout{Policy: policy, Stage: 0, Fleet: 4, Admitted: []string{"a"}, Failed: []string{"a"}, SoakUntil: now},
+			1, time.Time{},
+		},
+		{
+			"no soak time",
+			Rollout{Policy: Policy{Canaries: 1, BatchPercent: 50, FailureThreshold: 100}, Stage: 0, Fleet: 4, Admitted: []string{"a"}, Succeeded: []string{"a"}},
+			1, time.Time{},
+		},
+		{
+			"halted",
+			Rollout{Policy: policy, Stage: 0, Fleet: 4, Admitted: []string{"a"}, Failed: []string{"a"}, SoakUntil: now, Halted: true},
+			0, now,
+		},
+		{
+			"whole fleet allowed",
+			Rollout{Policy: policy, Stage: 2, Fleet: 4, Admitted: []string{"a", "b", "c", "d"}, Succeeded: []string{"a", "b", "c", "d"}},
+			2, time.Time{},
+		},
+	}
+
+	for _, test := range tests {
+		test.rollout.Advance(now)
+		if test.rollout.Stage != test.stage || !test.rollout.SoakUntil.Equal(test.soakUntil) {
+			t.Errorf("%s: Advance() stage %d soaking until %s, expected stage %d soaking until %s",
+				test.name, test.rollout.Stage, test.rollout.SoakUntil, test.stage, test.soakUntil)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	type result struct {
+		device  string
+		success bool
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		admitted  []string
+		results   []result
+		succeeded int
+		failed    int
+		halted    bool
+	}{
+		{"all succeeded", 0, []string{"a", "b"}, []result{{"a", true}, {"b", true}}, 2, 0, false},
+		{"at threshold", 50, []string{"a", "b", "c", "d"}, []result{{"a", false}, {"b", false}, {"c", true}}, 1, 2, false},
+		{"over threshold", 50, []string{"a", "b", "c", "d"}, []result{{"a", false}, {"b", false}, {"c", false}}, 0, 3, true},
+		{"no failures allowed", 0, []string{"a", "b", "c", "d"}, []result{{"a", true}, {"b", false}}, 1, 1, true},
+		{"never halts", 100, []string{"a"}, []result{{"a", false}}, 0, 1, false},
+		{"recorded again", 50, []string{"a", "b", "c", "d"}, []result{{"a", false}, {"a", false}, {"a", false}}, 0, 1, false},
+		{"retried successfully", 0, []string{"a", "b"}, []result{{"a", true}, {"b", true}, {"a", true}}, 2, 0, false},
+		{"failure replaced by success", 100, []string{"a"}, []result{{"a", false}, {"a", true}}, 1, 0, false},
+	}
+
+	for _, test := range tests {
+		r := New(1, "commit", Policy{BatchPercent: 100, FailureThreshold: test.threshold})
+		r.Fleet = len(test.admitted)
+		r.Admitted = test.admitted
+
+		for _, result := range test.results {
+			r.Record(result.device, result.success)
+		}
+
+		if len(r.Succeeded) != test.succeeded || len(r.Failed) != test.failed || r.Halted != test.halted {
+			t.Errorf("%s: Record() succeeded %v, failed %v, halted %t, expected %d succeeded, %d failed, halted %t",
+				test.name, r.Succeeded, r.Failed, r.Halted, test.succeeded, test.failed, test.halted)
+		}
+
+		if r.Halted && r.HaltReason == "" {
+			t.Errorf("%s: Record() halted without a reason", test.name)
+		}
+	}
+}
+
+func TestGetPolicy(t *testing.T) {
+	tests := []struct {
+		config map[string]interface{}
+		policy Policy
+		err    bool
+	}{
+		{nil, Policy{BatchPercent: 100, FailureThreshold: 100}, false},
+		{
+			map[string]interface{}{canariesKey: "2", batchPercentKey: "25", soakTimeKey: "60", failureThresholdKey: "10"},
+			Policy{Canaries: 2, BatchPercent: 25, SoakTime: time.Minute, FailureThreshold: 10},
+			false,
+		},
+		{map[string]interface{}{canariesKey: 3.0}, Policy{Canaries: 3, BatchPercent: 100, FailureThreshold: 100}, false},
+		{map[string]interface{}{canariesKey: "-1"}, Policy{}, true},
+		{map[string]interface{}{batchPercentKey: "0"}, Policy{}, true},
+		{map[string]interface{}{batchPercentKey: "101"}, Policy{}, true},
+		{map[string]interface{}{failureThresholdKey: "101"}, Policy{}, true},
+		{map[string]interface{}{soakTimeKey: "soon"}, Policy{}, true},
+	}
+
+	for _, test := range tests {
+		policy, err := GetPolicy(test.config)
+		if test.err {
+			if err == nil {
+				t.Errorf("GetPolicy(%v) expected an error, got %+v", test.config, policy)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("GetPolicy(%v) unexpected error: %v", test.config, err)
+		} else if policy != test.policy {
+			t.Errorf("GetPolicy(%v) = %+v, expected %+v", test.config, policy, test.policy)
+		}
+	}
+}
@@ -1,21 +1,47 @@
 package board
 
+import (
+	"time"
+
+	"github.com/resin-io/edge-node-manager/radio"
+)
+
 type Type string
 
 const (
 	MICROBIT   Type = "microbit"
 	NRF51822DK      = "nrf51822dk"
+	NRF52DK         = "nrf52dk"
 	ESP8266         = "esp8266"
 )
 
+// Step defines the steps of a firmware update
+type Step string
+
+const (
+	BOOTLOADER Step = "Bootloader entry"
+	INITIALISE      = "Initialise"
+	TRANSFER        = "Transfer"
+	VALIDATE        = "Validate"
+	ACTIVATE        = "Activate"
+)
+
+// Progress is called during an update with the current step and the number of bytes acknowledged by the device
+// The size is zero if it is not known yet
+type Progress func(step Step, acknowledged, size int)
+
 type Interface interface {
+	Radio() radio.Type
 	InitialiseRadio() error
 	CleanupRadio() error
-	Update(filePath string) error
+	Update(filePath string, progress Progress) error
 	Scan(applicationUUID int) (map[string]struct{}, error)
 	Online() (bool, error)
 	Restart() error
-	Identify() error
-	UpdateConfig(interface{}) error
-	UpdateEnvironment(interface{}) error
+	Identify(duration time.Duration) error
+	UpdateConfig(map[string]interface{}) error
+	UpdateEnvironment(map[string]interface{}) error
+	Decommission() error
+	// Version returns the identifier of the firmware running on the device, or an empty string if it does not report one
+	Version() (string, error)
 }
@@ -2,10 +2,15 @@ package esp8266
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"strconv"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/resin-io/edge-node-manager/board"
+	"github.com/resin-io/edge-node-manager/failure"
+	"github.com/resin-io/edge-node-manager/radio"
 	"github.com/resin-io/edge-node-manager/radio/wifi"
 )
 
@@ -14,6 +19,10 @@ type Esp8266 struct {
 	LocalUUID string
 }
 
+func (b Esp8266) Radio() radio.Type {
+	return radio.WIFI
+}
+
 func (b Esp8266) InitialiseRadio() error {
 	return wifi.Initialise()
 }
@@ -22,17 +31,27 @@ func (b Esp8266) CleanupRadio() error {
 	return wifi.Cleanup()
 }
 
-func (b Esp8266) Update(filePath string) error {
+func (b Esp8266) Update(filePath string, progress board.Progress) error {
 	b.Log.Info("Starting update")
 
+	firmware := path.Join(filePath, "firmware.bin")
+	info, err := os.Stat(firmware)
+	if err != nil {
+		return failure.Incompatible(err)
+	}
+	size := int(info.Size())
+
 	ip, err := wifi.GetIP(b.LocalUUID)
 	if err != nil {
 		return err
 	}
 
-	if err := wifi.PostForm("http://"+ip+"/update", path.Join(filePath, "firmware.bin")); err != nil {
+	// The device only acknowledges the firmware once it has received all of it, it then activates it
+	progress(board.TRANSFER, 0, size)
+	if err := wifi.PostForm("http://"+ip+"/update", firmware); err != nil {
 		return err
 	}
+	progress(board.ACTIVATE, size, size)
 
 	b.Log.Info("Finished update")
 
@@ -49,24 +68,97 @@ func (b Esp8266) Online() (bool, error) {
 
 func (b Esp8266) Restart() error {
 	b.Log.Info("Restarting...")
-	return fmt.Errorf("Restart not implemented")
+
+	ip, err := wifi.GetIP(b.LocalUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := wifi.Post("http://" + ip + "/restart"); err != nil {
+		return err
+	}
+
+	b.Log.Info("Restarted")
+
+	return nil
 }
 
-func (b Esp8266) Identify() error {
-	b.Log.Info("Identifying...")
-	return fmt.Errorf("Identify not implemented")
+func (b Esp8266) Identify(duration time.Duration) error {
+	b.Log.WithFields(log.Fields{
+		"Duration": duration,
+	}).Info("Identifying...")
+
+	ip, err := wifi.GetIP(b.LocalUUID)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s/identify?duration=%d", ip, (int)(duration.Seconds()))
+	if err := wifi.Post(url); err != nil {
+		return err
+	}
+
+	b.Log.Info("Identified")
+
+	return nil
 }
 
-func (b Esp8266) UpdateConfig(config interface{}) error {
+func (b Esp8266) UpdateConfig(config map[string]interface{}) error {
 	b.Log.WithFields(log.Fields{
 		"Config": config,
 	}).Info("Updating config...")
-	return fmt.Errorf("Update config not implemented")
+
+	ip, err := wifi.GetIP(b.LocalUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := wifi.PostJSON("http://"+ip+"/config", config); err != nil {
+		return err
+	}
+
+	b.Log.Info("Updated config")
+
+	return nil
 }
 
-func (b Esp8266) UpdateEnvironment(config interface{}) error {
+func (b Esp8266) UpdateEnvironment(environment map[string]interface{}) error {
 	b.Log.WithFields(log.Fields{
-		"Config": config,
+		"Environment": environment,
 	}).Info("Updating environment...")
-	return fmt.Errorf("Update environment not implemented")
+
+	ip, err := wifi.GetIP(b.LocalUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := wifi.PostJSON("http://"+ip+"/environment", environment); err != nil {
+		return err
+	}
+
+	b.Log.Info("Updated environment")
+
+	return nil
+}
+
+func (b Esp8266) Decommission() error {
+	b.Log.Info("Decommissioning...")
+
+	ip, err := wifi.GetIP(b.LocalUUID)
+	if err != nil {
+		return err
+	}
+
+	if err := wifi.Post("http://" + ip + "/decommission"); err != nil {
+		return err
+	}
+
+	b.Log.Info("Decommissioned")
+
+	return nil
+}
+
+// Version returns the firmware version advertised by the device's mDNS service
+func (b Esp8266) Version() (string, error) {
+	return wifi.GetVersion(b.LocalUUID)
 }
@@ -1,27 +1,41 @@
 package nrf51822dk
 
 import (
-	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/currantlabs/ble"
+	"github.com/resin-io/edge-node-manager/board"
 	"github.com/resin-io/edge-node-manager/config"
 	"github.com/resin-io/edge-node-manager/micro/nrf51822"
+	"github.com/resin-io/edge-node-manager/radio"
 	"github.com/resin-io/edge-node-manager/radio/bluetooth"
 )
 
+// ReceiptInterval is the number of firmware packets the bootloader receives between receipts
+const ReceiptInterval = 100
+
 type Nrf51822dk struct {
 	Log   *log.Logger
 	Micro nrf51822.Nrf51822
 }
 
 var (
-	dfu          *ble.Characteristic
-	shortTimeout time.Duration
+	dfu           *ble.Characteristic
+	configuration *ble.Characteristic
+	environment   *ble.Characteristic
+	decommission  *ble.Characteristic
+	firmware      *ble.Characteristic
+	led           *ble.Characteristic
+	shortTimeout  time.Duration
 )
 
+func (b Nrf51822dk) Radio() radio.Type {
+	return radio.BLUETOOTH
+}
+
 func (b Nrf51822dk) InitialiseRadio() error {
 	return b.Micro.InitialiseRadio()
 }
@@ -30,85 +44,217 @@ func (b Nrf51822dk) CleanupRadio() error {
 	return b.Micro.CleanupRadio()
 }
 
-func (b Nrf51822dk) Update(filePath string) error {
+func (b Nrf51822dk) Update(filePath string, progress board.Progress) error {
 	b.Log.Info("Starting update")
 
-	if err := b.Micro.ExtractFirmware(filePath, "nrf51422_xxac_s130.bin", "nrf51422_xxac_s130.dat"); err != nil {
-		return err
-	}
+	b.Micro.Progress = progress
 
-	name, err := bluetooth.GetName(b.Micro.LocalUUID)
+	images, err := b.Micro.ExtractFirmware(filePath)
 	if err != nil {
 		return err
 	}
 
-	if name != "DfuTarg" {
-		b.Log.Debug("Starting bootloader")
+	// The device restarts into its bootloader after each image so the next one is flashed from the bootloader
+	for _, image := range images {
+		b.Micro.Firmware = image
+
+		progress(board.BOOTLOADER, 0, 0)
+		if err := b.startBootloader(); err != nil {
+			return err
+		}
 
 		client, err := bluetooth.Connect(b.Micro.LocalUUID)
 		if err != nil {
 			return err
 		}
 
-		if err = bluetooth.WriteDescriptor(client, dfu.CCCD, []byte{0x001}); err != nil {
+		// The device disconnects once the image is activated, the connection is closed if it has not or the
+		// update failed so the device is not left connected in its bootloader
+		err = b.Micro.Update(client)
+		bluetooth.Close(client)
+		if err != nil {
 			return err
 		}
+	}
 
-		// Ignore the error because this command causes the device to disconnect
-		bluetooth.WriteCharacteristic(client, dfu, []byte{nrf51822.Start, 0x04}, false)
+	b.Log.Info("Finished update")
 
-		// Give the device time to disconnect
-		time.Sleep(shortTimeout)
+	return nil
+}
 
-		b.Log.Debug("Started bootloader")
-	} else {
-		b.Log.Debug("Bootloader already started")
+func (b Nrf51822dk) Scan(applicationUUID int) (map[string]struct{}, error) {
+	return bluetooth.Scan(strconv.Itoa(applicationUUID))
+}
+
+func (b Nrf51822dk) Online() (bool, error) {
+	return bluetooth.Online(b.Micro.LocalUUID)
+}
+
+func (b Nrf51822dk) Restart() error {
+	b.Log.Info("Restarting...")
+
+	if err := b.startBootloader(); err != nil {
+		return err
 	}
 
 	client, err := bluetooth.Connect(b.Micro.LocalUUID)
 	if err != nil {
 		return err
 	}
+	defer bluetooth.Close(client)
 
-	if err := b.Micro.Update(client); err != nil {
+	if err := b.Micro.Restart(client); err != nil {
 		return err
 	}
 
-	b.Log.Info("Finished update")
+	b.Log.Info("Restarted")
 
 	return nil
 }
 
-func (b Nrf51822dk) Scan(applicationUUID int) (map[string]struct{}, error) {
-	return bluetooth.Scan(strconv.Itoa(applicationUUID))
-}
+func (b Nrf51822dk) Identify(duration time.Duration) error {
+	b.Log.WithFields(log.Fields{
+		"Duration": duration,
+	}).Info("Identifying...")
 
-func (b Nrf51822dk) Online() (bool, error) {
-	return bluetooth.Online(b.Micro.LocalUUID)
-}
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+	defer bluetooth.Close(client)
 
-func (b Nrf51822dk) Restart() error {
-	b.Log.Info("Restarting...")
-	return fmt.Errorf("Restart not implemented")
-}
+	// Blink the LED
+	if err := bluetooth.Toggle(client, led, []byte{0x01}, []byte{0x00}, duration); err != nil {
+		return err
+	}
+
+	if err := bluetooth.Disconnect(client); err != nil {
+		return err
+	}
+
+	b.Log.Info("Identified")
 
-func (b Nrf51822dk) Identify() error {
-	b.Log.Info("Identifying...")
-	return fmt.Errorf("Identify not implemented")
+	return nil
 }
 
-func (b Nrf51822dk) UpdateConfig(config interface{}) error {
+func (b Nrf51822dk) UpdateConfig(variables map[string]interface{}) error {
 	b.Log.WithFields(log.Fields{
-		"Config": config,
+		"Config": variables,
 	}).Info("Updating config...")
-	return fmt.Errorf("Update config not implemented")
+
+	if err := b.writeVariables(configuration, variables); err != nil {
+		return err
+	}
+
+	b.Log.Info("Updated config")
+
+	return nil
 }
 
-func (b Nrf51822dk) UpdateEnvironment(config interface{}) error {
+func (b Nrf51822dk) UpdateEnvironment(variables map[string]interface{}) error {
 	b.Log.WithFields(log.Fields{
-		"Config": config,
+		"Environment": variables,
 	}).Info("Updating environment...")
-	return fmt.Errorf("Update environment not implemented")
+
+	if err := b.writeVariables(environment, variables); err != nil {
+		return err
+	}
+
+	b.Log.Info("Updated environment")
+
+	return nil
+}
+
+func (b Nrf51822dk) Decommission() error {
+	b.Log.Info("Decommissioning...")
+
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+	defer bluetooth.Close(client)
+
+	// The device disconnects once it has decommissioned itself, which may interrupt the write
+	writeErr := bluetooth.WriteCharacteristic(client, decommission, []byte{0x01}, false)
+	if err := bluetooth.AwaitDisconnect(client); err != nil {
+		if writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	b.Log.Info("Decommissioned")
+
+	return nil
+}
+
+// Version reads the Device Information Service firmware revision, which the resin firmware sets to its commit
+func (b Nrf51822dk) Version() (string, error) {
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return "", err
+	}
+	defer bluetooth.Close(client)
+
+	resp, err := bluetooth.ReadCharacteristic(client, firmware)
+	if err != nil {
+		return "", err
+	}
+
+	if err := bluetooth.Disconnect(client); err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(resp), "\x00 "), nil
+}
+
+// startBootloader restarts the device into the bootloader if it is not already running
+func (b Nrf51822dk) startBootloader() error {
+	name, err := bluetooth.GetName(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+
+	if name != "DfuTarg" {
+		b.Log.Debug("Starting bootloader")
+
+		client, err := bluetooth.Connect(b.Micro.LocalUUID)
+		if err != nil {
+			return err
+		}
+		defer bluetooth.Close(client)
+
+		if err = bluetooth.WriteDescriptor(client, dfu.CCCD, []byte{0x001}); err != nil {
+			return err
+		}
+
+		// Ignore the error because this command causes the device to disconnect
+		bluetooth.WriteCharacteristic(client, dfu, []byte{nrf51822.Start, 0x04}, false)
+
+		// Give the device time to disconnect
+		time.Sleep(shortTimeout)
+
+		b.Log.Debug("Started bootloader")
+	} else {
+		b.Log.Debug("Bootloader already started")
+	}
+
+	return nil
+}
+
+// writeVariables writes the variables to the device, the device acknowledges each one
+func (b Nrf51822dk) writeVariables(characteristic *ble.Characteristic, variables map[string]interface{}) error {
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+	defer bluetooth.Close(client)
+
+	if err := bluetooth.WriteVariables(client, characteristic, variables); err != nil {
+		return err
+	}
+
+	return bluetooth.Disconnect(client)
 }
 
 func init() {
@@ -132,5 +278,30 @@ func init() {
 	}
 	dfu.CCCD = descriptor
 
+	configuration, err = bluetooth.GetCharacteristic("524553494e0000000000000000000001", ble.CharWrite, 0x20, 0x21)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	environment, err = bluetooth.GetCharacteristic("524553494e0000000000000000000002", ble.CharWrite, 0x23, 0x24)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	decommission, err = bluetooth.GetCharacteristic("524553494e0000000000000000000003", ble.CharWrite, 0x26, 0x27)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	led, err = bluetooth.GetCharacteristic("000015251212efde1523785feabcd123", ble.CharRead+ble.CharWrite, 0x2A, 0x2B)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	firmware, err = bluetooth.GetCharacteristic("2a26", ble.CharRead, 0x2D, 0x2E)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Debug("Initialised nRF51822-DK characteristics")
 }
@@ -0,0 +1,339 @@
+package nrf52dk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/currantlabs/ble"
+	"github.com/resin-io/edge-node-manager/board"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/micro/nrf52832"
+	"github.com/resin-io/edge-node-manager/radio"
+	"github.com/resin-io/edge-node-manager/radio/bluetooth"
+)
+
+// ReceiptInterval is the number of firmware packets the bootloader receives between receipts
+const ReceiptInterval = 12
+
+type Nrf52dk struct {
+	Log   *log.Logger
+	Micro nrf52832.Nrf52832
+}
+
+var (
+	buttonless    *ble.Characteristic
+	configuration *ble.Characteristic
+	environment   *ble.Characteristic
+	decommission  *ble.Characteristic
+	firmware      *ble.Characteristic
+	led           *ble.Characteristic
+	shortTimeout  time.Duration
+)
+
+func (b Nrf52dk) Radio() radio.Type {
+	return radio.BLUETOOTH
+}
+
+func (b Nrf52dk) InitialiseRadio() error {
+	return b.Micro.InitialiseRadio()
+}
+
+func (b Nrf52dk) CleanupRadio() error {
+	return b.Micro.CleanupRadio()
+}
+
+func (b Nrf52dk) Update(filePath string, progress board.Progress) error {
+	b.Log.Info("Starting update")
+
+	b.Micro.Progress = progress
+
+	images, err := b.Micro.ExtractFirmware(filePath)
+	if err != nil {
+		return err
+	}
+
+	// The device restarts into its bootloader after each image so the next one is flashed from the bootloader
+	for _, image := range images {
+		b.Micro.Firmware = image
+
+		progress(board.BOOTLOADER, 0, 0)
+		bootloader, err := b.startBootloader()
+		if err != nil {
+			return err
+		}
+
+		client, err := bluetooth.Connect(bootloader)
+		if err != nil {
+			return err
+		}
+
+		// The device disconnects once the image is activated, the connection is closed if it has not or the
+		// update failed so the device is not left connected in its bootloader
+		err = b.Micro.Update(client)
+		bluetooth.Close(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Log.Info("Finished update")
+
+	return nil
+}
+
+func (b Nrf52dk) Scan(applicationUUID int) (map[string]struct{}, error) {
+	return bluetooth.Scan(strconv.Itoa(applicationUUID))
+}
+
+// Online returns true if either the application or the bootloader is advertising
+// A device left in its bootloader by an interrupted update must be online for the update to be resumed
+func (b Nrf52dk) Online() (bool, error) {
+	online, err := bluetooth.Online(b.Micro.LocalUUID)
+	if err != nil || online {
+		return online, err
+	}
+
+	bootloader, err := b.Micro.BootloaderUUID()
+	if err != nil {
+		return false, err
+	}
+
+	return bluetooth.Online(bootloader)
+}
+
+// Restart resets the device through its bootloader, it has only restarted once the application is advertising again
+// rather than the bootloader
+func (b Nrf52dk) Restart() error {
+	b.Log.Info("Restarting...")
+
+	bootloader, err := b.startBootloader()
+	if err != nil {
+		return err
+	}
+
+	client, err := bluetooth.Connect(bootloader)
+	if err != nil {
+		return err
+	}
+
+	err = b.Micro.Restart(client)
+	bluetooth.Close(client)
+	if err != nil {
+		return err
+	}
+
+	online, err := bluetooth.Online(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	} else if !online {
+		return fmt.Errorf("Device did not restart into its application")
+	}
+
+	b.Log.Info("Restarted")
+
+	return nil
+}
+
+func (b Nrf52dk) Identify(duration time.Duration) error {
+	b.Log.WithFields(log.Fields{
+		"Duration": duration,
+	}).Info("Identifying...")
+
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+	defer bluetooth.Close(client)
+
+	// Blink the LED
+	if err := bluetooth.Toggle(client, led, []byte{0x01}, []byte{0x00}, duration); err != nil {
+		return err
+	}
+
+	if err := bluetooth.Disconnect(client); err != nil {
+		return err
+	}
+
+	b.Log.Info("Identified")
+
+	return nil
+}
+
+func (b Nrf52dk) UpdateConfig(variables map[string]interface{}) error {
+	b.Log.WithFields(log.Fields{
+		"Config": variables,
+	}).Info("Updating config...")
+
+	if err := b.writeVariables(configuration, variables); err != nil {
+		return err
+	}
+
+	b.Log.Info("Updated config")
+
+	return nil
+}
+
+func (b Nrf52dk) UpdateEnvironment(variables map[string]interface{}) error {
+	b.Log.WithFields(log.Fields{
+		"Environment": variables,
+	}).Info("Updating environment...")
+
+	if err := b.writeVariables(environment, variables); err != nil {
+		return err
+	}
+
+	b.Log.Info("Updated environment")
+
+	return nil
+}
+
+func (b Nrf52dk) Decommission() error {
+	b.Log.Info("Decommissioning...")
+
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+	defer bluetooth.Close(client)
+
+	// The device disconnects once it has decommissioned itself, which may interrupt the write
+	writeErr := bluetooth.WriteCharacteristic(client, decommission, []byte{0x01}, false)
+	if err := bluetooth.AwaitDisconnect(client); err != nil {
+		if writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	b.Log.Info("Decommissioned")
+
+	return nil
+}
+
+// Version reads the Device Information Service firmware revision, which the resin firmware sets to its commit
+func (b Nrf52dk) Version() (string, error) {
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return "", err
+	}
+	defer bluetooth.Close(client)
+
+	resp, err := bluetooth.ReadCharacteristic(client, firmware)
+	if err != nil {
+		return "", err
+	}
+
+	if err := bluetooth.Disconnect(client); err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(resp), "\x00 "), nil
+}
+
+// startBootloader restarts the device into the bootloader through the buttonless DFU service if it is running its
+// application and returns the address the bootloader advertises with
+func (b Nrf52dk) startBootloader() (string, error) {
+	bootloader, err := b.Micro.BootloaderUUID()
+	if err != nil {
+		return "", err
+	}
+
+	online, err := bluetooth.Online(b.Micro.LocalUUID)
+	if err != nil {
+		return "", err
+	}
+
+	if online {
+		b.Log.Debug("Starting bootloader")
+
+		client, err := bluetooth.Connect(b.Micro.LocalUUID)
+		if err != nil {
+			return "", err
+		}
+		defer bluetooth.Close(client)
+
+		// The buttonless service only accepts the command once indications are enabled
+		if err = bluetooth.WriteDescriptor(client, buttonless.CCCD, []byte{0x02, 0x00}); err != nil {
+			return "", err
+		}
+
+		// Ignore the error because this command causes the device to disconnect
+		bluetooth.WriteCharacteristic(client, buttonless, []byte{0x01}, false)
+
+		// Give the device time to disconnect
+		time.Sleep(shortTimeout)
+
+		b.Log.Debug("Started bootloader")
+	} else {
+		b.Log.Debug("Bootloader already started")
+	}
+
+	return bootloader, nil
+}
+
+// writeVariables writes the variables to the device, the device acknowledges each one
+func (b Nrf52dk) writeVariables(characteristic *ble.Characteristic, variables map[string]interface{}) error {
+	client, err := bluetooth.Connect(b.Micro.LocalUUID)
+	if err != nil {
+		return err
+	}
+	defer bluetooth.Close(client)
+
+	if err := bluetooth.WriteVariables(client, characteristic, variables); err != nil {
+		return err
+	}
+
+	return bluetooth.Disconnect(client)
+}
+
+func init() {
+	log.SetLevel(config.GetLogLevel())
+
+	var err error
+	if shortTimeout, err = config.GetShortBluetoothTimeout(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load bluetooth timeout")
+	}
+
+	buttonless, err = bluetooth.GetCharacteristic("8ec90003f3154f609fb8838830daea50", ble.CharWrite+ble.CharIndicate, 0x0F, 0x10)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	descriptor, err := bluetooth.GetDescriptor("2902", 0x11)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buttonless.CCCD = descriptor
+
+	configuration, err = bluetooth.GetCharacteristic("524553494e0000000000000000000001", ble.CharWrite, 0x20, 0x21)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	environment, err = bluetooth.GetCharacteristic("524553494e0000000000000000000002", ble.CharWrite, 0x23, 0x24)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	decommission, err = bluetooth.GetCharacteristic("524553494e0000000000000000000003", ble.CharWrite, 0x26, 0x27)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	led, err = bluetooth.GetCharacteristic("000015251212efde1523785feabcd123", ble.CharRead+ble.CharWrite, 0x2A, 0x2B)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	firmware, err = bluetooth.GetCharacteristic("2a26", ble.CharRead, 0x2D, 0x2E)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Debug("Initialised nRF52-DK characteristics")
+}
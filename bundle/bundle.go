@@ -0,0 +1,510 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/supervisor"
+)
+
+var (
+	maxSize    int64
+	fetchMutex sync.Mutex
+	fetchLocks = make(map[string]*sync.Mutex)
+	fetching   = make(map[string]struct{})
+)
+
+var (
+	downloadMutex sync.Mutex
+	downloads     = make(map[string]*Download)
+)
+
+// Download describes the progress of a firmware bundle download
+type Download struct {
+	ApplicationUUID int
+	Commit          string
+	Received        int64
+	Size            int64
+	BytesPerSecond  float64
+	Started         time.Time
+}
+
+// GetDownload returns the progress of the bundle's download, or false if it is not being downloaded
+func GetDownload(applicationUUID int, commit string) (Download, bool) {
+	downloadMutex.Lock()
+	defer downloadMutex.Unlock()
+
+	download, ok := downloads[Key(applicationUUID, commit)]
+	if !ok {
+		return Download{}, false
+	}
+	return *download, true
+}
+
+// GetDownloads returns the progress of every bundle being downloaded
+func GetDownloads() []Download {
+	downloadMutex.Lock()
+	defer downloadMutex.Unlock()
+
+	var result []Download
+	for _, download := range downloads {
+		result = append(result, *download)
+	}
+	return result
+}
+
+const (
+	tarName      = "binary.tar"
+	checksumName = "binary.tar.sha256"
+	manifestName = "SHA256SUMS"
+	partial      = ".partial"
+)
+
+// Get returns the directory holding the verified, extracted firmware bundle for the commit
+// A missing or corrupt bundle is downloaded again, concurrent calls for the same bundle wait for a single download
+// Cancelling the context stops the download, which is resumed by the next call
+func Get(ctx context.Context, applicationUUID int, commit string) (string, error) {
+	release := acquire(Key(applicationUUID, commit))
+	defer release()
+
+	dir := Dir(applicationUUID, commit)
+
+	err := Verify(dir)
+	if err == nil {
+		touch(dir)
+		return dir, nil
+	}
+
+	if _, statErr := os.Stat(dir); statErr == nil {
+		log.WithFields(log.Fields{
+			"Directory": dir,
+			"Error":     err,
+		}).Warn("Firmware bundle corrupt, downloading again")
+	}
+
+	if err := fetch(ctx, applicationUUID, commit, dir); err != nil {
+		return "", err
+	}
+	touch(dir)
+
+	return dir, nil
+}
+
+// Cached returns true if the bundle has been downloaded, it is verified by Get before it is used
+func Cached(applicationUUID int, commit string) bool {
+	_, err := os.Stat(path.Join(Dir(applicationUUID, commit), checksumName))
+	return err == nil
+}
+
+// Dir returns the directory used to store the firmware bundle for the commit
+func Dir(applicationUUID int, commit string) string {
+	return path.Join(config.GetAssetsDir(), strconv.Itoa(applicationUUID), commit)
+}
+
+// Verify checks the bundle against the checksum recorded when it was downloaded and against its manifest if it has one
+func Verify(dir string) error {
+	expected, err := ioutil.ReadFile(path.Join(dir, checksumName))
+	if err != nil {
+		return err
+	}
+
+	actual, _, err := hashFile(path.Join(dir, tarName))
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(actual) != strings.TrimSpace(string(expected)) {
+		return fmt.Errorf("%s checksum mismatch", tarName)
+	}
+
+	if err := verifySignature(dir); err != nil {
+		return err
+	}
+
+	_, err = verifyManifest(dir)
+	return err
+}
+
+// fetch downloads and extracts the bundle in a staging directory, verifies it, then renames it into place
+// A partially downloaded tarball is kept in the staging directory so that the download can be resumed
+func fetch(ctx context.Context, applicationUUID int, commit, dir string) error {
+	staging := dir + partial
+	if err := clearStaging(staging); err != nil {
+		return err
+	}
+
+	header, err := transfer(ctx, applicationUUID, commit, staging)
+	if err != nil {
+		return err
+	}
+
+	// Start from scratch next time if the download is corrupt, it may have been resumed from a bad partial download
+	if err := unpack(applicationUUID, commit, staging, header); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	return os.Rename(staging, dir)
+}
+
+// clearStaging removes everything but the partially downloaded tarball from the staging directory
+func clearStaging(staging string) error {
+	files, err := ioutil.ReadDir(staging)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Name() == tarName {
+			continue
+		}
+
+		if err := os.RemoveAll(path.Join(staging, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// transfer downloads the tarball into the staging directory, recording the progress of the download
+func transfer(ctx context.Context, applicationUUID int, commit, staging string) (http.Header, error) {
+	key := Key(applicationUUID, commit)
+	started := time.Now()
+
+	downloadMutex.Lock()
+	downloads[key] = &Download{
+		ApplicationUUID: applicationUUID,
+		Commit:          commit,
+		Started:         started,
+	}
+	downloadMutex.Unlock()
+
+	defer func() {
+		downloadMutex.Lock()
+		delete(downloads, key)
+		downloadMutex.Unlock()
+	}()
+
+	var resumed int64
+	if info, err := os.Stat(path.Join(staging, tarName)); err == nil {
+		resumed = info.Size()
+
+		log.WithFields(log.Fields{
+			"Application": applicationUUID,
+			"Commit":      commit,
+			"Received":    resumed,
+		}).Info("Resuming firmware download")
+	}
+
+	progress := func(received, size int64) {
+		downloadMutex.Lock()
+		defer downloadMutex.Unlock()
+
+		download := downloads[key]
+		download.Received = received
+		download.Size = size
+		if elapsed := time.Since(started).Seconds(); elapsed > 0 && received > resumed {
+			download.BytesPerSecond = (float64)(received-resumed) / elapsed
+		}
+	}
+
+	return supervisor.DependentApplicationUpdate(ctx, applicationUUID, commit, path.Join(staging, tarName), progress)
+}
+
+// unpack verifies the downloaded tarball and extracts it into the staging directory
+func unpack(applicationUUID int, commit, staging string, header http.Header) error {
+	tarPath := path.Join(staging, tarName)
+
+	sum, size, err := hashFile(tarPath)
+	if err != nil {
+		return err
+	}
+
+	verified, err := verifyHeader(header, sum, size)
+	if err != nil {
+		return err
+	}
+
+	if err := untar(staging, tarPath); err != nil {
+		return err
+	}
+
+	if err := verifySignature(staging); err != nil {
+		return err
+	}
+
+	listed, err := verifyManifest(staging)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyComplete(staging, listed); err != nil {
+		return err
+	}
+
+	if !verified && listed == nil {
+		log.WithFields(log.Fields{
+			"Application": applicationUUID,
+			"Commit":      commit,
+		}).Warn("Unable to verify firmware bundle, no checksum or manifest provided")
+	}
+
+	// Record the checksum so the cached bundle can be checked before each use
+	return ioutil.WriteFile(path.Join(staging, checksumName), []byte(hex.EncodeToString(sum)+"\n"), 0644)
+}
+
+// untar extracts the bundle's directories and regular files into the directory
+// The bundle is not trusted until it has been verified so entries which would be written outside the directory,
+// over the bundle itself or as links are rejected
+func untar(dir, tarPath string) error {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(header.Name) || name == ".." || strings.HasPrefix(name, "../") {
+			return RejectedError{header.Name + " is outside the bundle"}
+		}
+
+		switch name {
+		case ".":
+			continue
+		case tarName, checksumName:
+			return RejectedError{header.Name + " is reserved"}
+		}
+
+		target := path.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := extract(target, reader); err != nil {
+				return err
+			}
+		default:
+			return RejectedError{header.Name + " is not a regular file or directory"}
+		}
+	}
+}
+
+func extract(target string, r io.Reader) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// verifyHeader checks the download against the Content-Length and Digest headers, returning true if
+// the supervisor provided a checksum
+func verifyHeader(header http.Header, sum []byte, size int64) (bool, error) {
+	// A resumed download only responds with the remainder so use the complete length from the Content-Range
+	// e.g. Content-Range: bytes 1024-4095/4096
+	value := header.Get("Content-Length")
+	if contentRange := header.Get("Content-Range"); contentRange != "" {
+		value = contentRange[strings.LastIndex(contentRange, "/")+1:]
+		if value == "*" {
+			value = ""
+		}
+	}
+
+	if value != "" {
+		expected, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, err
+		}
+
+		if expected != size {
+			return false, fmt.Errorf("Download size %d does not match Content-Length %d", size, expected)
+		}
+	}
+
+	// RFC 3230 instance digest e.g. Digest: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=
+	for _, digest := range strings.Split(header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "SHA-256") {
+			continue
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(expected, sum) {
+			return false, fmt.Errorf("Download checksum does not match Digest")
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// verifyManifest checks every file listed in the bundle's SHA256SUMS manifest, returning the listed files
+// or nil if there is no manifest
+func verifyManifest(dir string) (map[string]struct{}, error) {
+	file, err := os.Open(path.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	listed := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// Lines are of the form "<checksum>  <file>", binary mode files are prefixed with "*"
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid %s entry: %s", manifestName, line)
+		}
+		name := strings.TrimPrefix(fields[1], "*")
+
+		if path.IsAbs(name) || strings.HasPrefix(path.Clean(name), "..") {
+			return nil, fmt.Errorf("Invalid %s file: %s", manifestName, name)
+		}
+
+		sum, _, err := hashFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if hex.EncodeToString(sum) != strings.ToLower(fields[0]) {
+			return nil, fmt.Errorf("%s checksum mismatch", name)
+		}
+
+		listed[path.Clean(name)] = struct{}{}
+	}
+
+	return listed, scanner.Err()
+}
+
+func init() {
+	log.SetLevel(config.GetLogLevel())
+
+	var err error
+	if maxSize, err = config.GetAssetsMaxSize(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load assets max size")
+	}
+
+	keys := config.GetFirmwarePublicKeys()
+	if keys == "" {
+		return
+	}
+
+	if trustedKeys, err = parseKeys(keys); err != nil || len(trustedKeys) == 0 {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load firmware public keys")
+	}
+
+	log.WithFields(log.Fields{
+		"Number of keys": len(trustedKeys),
+	}).Info("Firmware signature verification enabled")
+}
+
+// acquire serialises the use of the bundle, returning the function that releases it
+func acquire(key string) func() {
+	fetchMutex.Lock()
+	lock, ok := fetchLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		fetchLocks[key] = lock
+	}
+	fetchMutex.Unlock()
+
+	lock.Lock()
+
+	fetchMutex.Lock()
+	fetching[key] = struct{}{}
+	fetchMutex.Unlock()
+
+	return func() {
+		fetchMutex.Lock()
+		delete(fetching, key)
+		fetchMutex.Unlock()
+
+		lock.Unlock()
+	}
+}
+
+// inUse returns true if the bundle is being verified or downloaded
+func inUse(key string) bool {
+	fetchMutex.Lock()
+	defer fetchMutex.Unlock()
+
+	_, ok := fetching[key]
+	return ok
+}
+
+func hashFile(filePath string) ([]byte, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return hash.Sum(nil), size, nil
+}
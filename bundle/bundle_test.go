@@ -0,0 +1,240 @@
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestVerifyHeader(t *testing.T) {
+	content := []byte("firmware")
+	sum := sha256.Sum256(content)
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("other"))
+	size := int64(len(content))
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		size     int64
+		verified bool
+		err      bool
+	}{
+		{"no headers", http.Header{}, size, false, false},
+		{"content length", http.Header{"Content-Length": {"8"}}, size, false, false},
+		{"content length mismatch", http.Header{"Content-Length": {"9"}}, size, false, true},
+		{"invalid content length", http.Header{"Content-Length": {"eight"}}, size, false, true},
+		{"resumed", http.Header{"Content-Length": {"4"}, "Content-Range": {"bytes 4-7/8"}}, size, false, false},
+		{"resumed mismatch", http.Header{"Content-Length": {"4"}, "Content-Range": {"bytes 4-8/9"}}, size, false, true},
+		{"resumed unknown length", http.Header{"Content-Range": {"bytes 4-7/*"}}, size, false, false},
+		{"digest", http.Header{"Digest": {digest}}, size, true, false},
+		{"digest case", http.Header{"Digest": {"sha-256=" + base64.StdEncoding.EncodeToString(sum[:])}}, size, true, false},
+		{"digest among others", http.Header{"Digest": {"MD5=HUXZLQLMuI/KZ5KDcJPcOA==, " + digest}}, size, true, false},
+		{"digest mismatch", http.Header{"Digest": {"SHA-256=" + base64.StdEncoding.EncodeToString(other[:])}}, size, false, true},
+		{"invalid digest", http.Header{"Digest": {"SHA-256=!!"}}, size, false, true},
+		{"other digest", http.Header{"Digest": {"MD5=HUXZLQLMuI/KZ5KDcJPcOA=="}}, size, false, false},
+		{"size and digest", http.Header{"Content-Length": {"8"}, "Digest": {digest}}, size, true, false},
+	}
+
+	for _, test := range tests {
+		verified, err := verifyHeader(test.header, sum[:], test.size)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: verifyHeader() expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: verifyHeader() unexpected error: %v", test.name, err)
+		} else if verified != test.verified {
+			t.Errorf("%s: verifyHeader() = %t, expected %t", test.name, verified, test.verified)
+		}
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	files := map[string]string{
+		"application.bin": "application",
+		"data/config.dat": "config",
+	}
+	sum := func(name string) string {
+		s := sha256.Sum256([]byte(files[name]))
+		return hex.EncodeToString(s[:])
+	}
+
+	tests := []struct {
+		name     string
+		manifest *string
+		listed   []string
+		err      bool
+	}{
+		{"no manifest", nil, nil, false},
+		{"empty manifest", str(""), []string{}, false},
+		{"text mode", str(sum("application.bin") + "  application.bin\n"), []string{"application.bin"}, false},
+		{"binary mode", str(sum("application.bin") + " *application.bin\n"), []string{"application.bin"}, false},
+		{"upper case checksum", str(strings.ToUpper(sum("application.bin")) + "  application.bin\n"), []string{"application.bin"}, false},
+		{
+			"several files",
+			str(sum("application.bin") + "  application.bin\n\n" + sum("data/config.dat") + "  ./data/config.dat\n"),
+			[]string{"application.bin", "data/config.dat"},
+			false,
+		},
+		{"checksum mismatch", str(sum("data/config.dat") + "  application.bin\n"), nil, true},
+		{"missing file", str(sum("application.bin") + "  missing.bin\n"), nil, true},
+		{"malformed entry", str(sum("application.bin") + "\n"), nil, true},
+		{"parent directory", str(sum("application.bin") + "  ../application.bin\n"), nil, true},
+		{"absolute path", str(sum("application.bin") + "  /application.bin\n"), nil, true},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "bundle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		for name, content := range files {
+			if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if test.manifest != nil {
+			if err := ioutil.WriteFile(path.Join(dir, manifestName), []byte(*test.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		listed, err := verifyManifest(dir)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: verifyManifest() expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: verifyManifest() unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if (listed == nil) != (test.listed == nil) || len(listed) != len(test.listed) {
+			t.Errorf("%s: verifyManifest() = %v, expected %v", test.name, listed, test.listed)
+			continue
+		}
+
+		for _, name := range test.listed {
+			if _, ok := listed[name]; !ok {
+				t.Errorf("%s: verifyManifest() = %v, expected %v", test.name, listed, test.listed)
+			}
+		}
+	}
+}
+
+func TestUntar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+		files   []string
+		err     bool
+	}{
+		{"files", []*tar.Header{file("application.bin"), file("data/config.dat")}, []string{"application.bin", "data/config.dat"}, false},
+		{"directories", []*tar.Header{dir("./"), dir("data/"), file("./data/config.dat")}, []string{"data/config.dat"}, false},
+		{"parent directory", []*tar.Header{file("../application.bin")}, nil, true},
+		{"nested parent directory", []*tar.Header{file("data/../../application.bin")}, nil, true},
+		{"absolute path", []*tar.Header{file("/tmp/application.bin")}, nil, true},
+		{"symlink", []*tar.Header{{Name: "data", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}}, nil, true},
+		{"hard link", []*tar.Header{{Name: "application.bin", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}}, nil, true},
+		{"overwrites the bundle", []*tar.Header{file(tarName)}, nil, true},
+		{"overwrites the checksum", []*tar.Header{file(checksumName)}, nil, true},
+	}
+
+	for _, test := range tests {
+		staging, err := ioutil.TempDir("", "bundle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(staging)
+
+		tarPath := path.Join(staging, tarName)
+		if err := writeTar(tarPath, test.entries); err != nil {
+			t.Fatal(err)
+		}
+
+		err = untar(staging, tarPath)
+		if test.err {
+			if _, ok := err.(RejectedError); !ok {
+				t.Errorf("%s: untar() = %v, expected the bundle to be rejected", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: untar() unexpected error: %v", test.name, err)
+			continue
+		}
+
+		for _, name := range test.files {
+			content, err := ioutil.ReadFile(path.Join(staging, name))
+			if err != nil || string(content) != name {
+				t.Errorf("%s: untar() extracted %q as %q, %v", test.name, name, content, err)
+			}
+		}
+	}
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func file(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+}
+
+func dir(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+}
+
+// writeTar writes the entries to a tarball, each regular file's content is its cleaned name
+func writeTar(tarPath string, entries []*tar.Header) error {
+	out, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := tar.NewWriter(out)
+	for _, header := range entries {
+		content := []byte(path.Clean(header.Name))
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if _, err := writer.Write(content); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,177 @@
+package bundle
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/resin-io/edge-node-manager/config"
+)
+
+// Entry describes a cached firmware bundle
+type Entry struct {
+	ApplicationUUID int
+	Commit          string
+	Size            int64
+	LastUsed        time.Time
+	Referenced      bool
+}
+
+// Usage describes the firmware bundle cache
+type Usage struct {
+	Size      int64
+	MaxSize   int64
+	Bundles   []Entry
+	Downloads []Download
+}
+
+// Key identifies a bundle in the cache
+func Key(applicationUUID int, commit string) string {
+	return path.Join(strconv.Itoa(applicationUUID), commit)
+}
+
+// GetUsage lists the cached bundles, marking those whose keys are referenced
+func GetUsage(referenced map[string]struct{}) (Usage, error) {
+	usage := Usage{
+		MaxSize:   maxSize,
+		Downloads: GetDownloads(),
+	}
+
+	applications, err := ioutil.ReadDir(config.GetAssetsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return usage, nil
+		}
+		return usage, err
+	}
+
+	for _, application := range applications {
+		applicationUUID, err := strconv.Atoi(application.Name())
+		if err != nil || !application.IsDir() {
+			continue
+		}
+
+		commits, err := ioutil.ReadDir(path.Join(config.GetAssetsDir(), application.Name()))
+		if err != nil {
+			return usage, err
+		}
+
+		for _, commit := range commits {
+			if !commit.IsDir() {
+				continue
+			}
+
+			entry, err := getEntry(applicationUUID, commit)
+			if err != nil {
+				return usage, err
+			}
+			_, entry.Referenced = referenced[Key(applicationUUID, entry.Commit)]
+
+			usage.Size += entry.Size
+			usage.Bundles = append(usage.Bundles, entry)
+		}
+	}
+
+	return usage, nil
+}
+
+// Collect removes the bundles which are not referenced, least recently used first, until the cache fits within
+// the maximum size
+// Referenced bundles and their partial downloads are never removed, abandoned partial downloads are always removed
+// Bundles which are being downloaded are left alone
+func Collect(referenced map[string]struct{}) error {
+	usage, err := GetUsage(referenced)
+	if err != nil {
+		return err
+	}
+
+	var unreferenced []Entry
+	for _, entry := range usage.Bundles {
+		key := Key(entry.ApplicationUUID, strings.TrimSuffix(entry.Commit, partial))
+		_, ok := referenced[key]
+
+		switch {
+		case inUse(key):
+			continue
+		case strings.HasSuffix(entry.Commit, partial) && !ok:
+			if err := remove(entry, "Removing partial firmware download"); err != nil {
+				return err
+			}
+			usage.Size -= entry.Size
+		case !ok:
+			unreferenced = append(unreferenced, entry)
+		}
+	}
+
+	sort.Slice(unreferenced, func(i, j int) bool {
+		return unreferenced[i].LastUsed.Before(unreferenced[j].LastUsed)
+	})
+
+	for _, entry := range unreferenced {
+		if usage.Size <= maxSize {
+			break
+		}
+
+		if err := remove(entry, "Removing unused firmware"); err != nil {
+			return err
+		}
+		usage.Size -= entry.Size
+	}
+
+	if usage.Size > maxSize {
+		log.WithFields(log.Fields{
+			"Size":     usage.Size,
+			"Max size": maxSize,
+		}).Warn("Firmware cache exceeds max size, the remaining firmware is in use")
+	}
+
+	return nil
+}
+
+// touch marks the bundle as used for the least recently used eviction
+func touch(dir string) {
+	now := time.Now()
+	os.Chtimes(path.Join(dir, checksumName), now, now)
+}
+
+func getEntry(applicationUUID int, commit os.FileInfo) (Entry, error) {
+	entry := Entry{
+		ApplicationUUID: applicationUUID,
+		Commit:          commit.Name(),
+		LastUsed:        commit.ModTime(),
+	}
+
+	dir := Dir(applicationUUID, commit.Name())
+	if info, err := os.Stat(path.Join(dir, checksumName)); err == nil {
+		entry.LastUsed = info.ModTime()
+	}
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			entry.Size += info.Size()
+		}
+		return nil
+	})
+
+	return entry, err
+}
+
+func remove(entry Entry, message string) error {
+	log.WithFields(log.Fields{
+		"Application": entry.ApplicationUUID,
+		"Commit":      entry.Commit,
+		"Size":        entry.Size,
+		"Last used":   entry.LastUsed,
+	}).Info(message)
+
+	return os.RemoveAll(Dir(entry.ApplicationUUID, entry.Commit))
+}
@@ -0,0 +1,133 @@
+package bundle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+// signatureName is the detached signature over the manifest, an ASN.1 encoded ECDSA P-256 SHA-256 signature
+// as produced by "openssl dgst -sha256 -sign key.pem -out SHA256SUMS.sig SHA256SUMS"
+const signatureName = manifestName + ".sig"
+
+// RejectedError is returned when a bundle fails signature verification
+type RejectedError struct {
+	Reason string
+}
+
+func (e RejectedError) Error() string {
+	return "Firmware rejected: " + e.Reason
+}
+
+// Category classifies the rejection, the firmware will be rejected again until the target commit changes
+func (e RejectedError) Category() failure.Category {
+	return failure.REJECTED
+}
+
+var trustedKeys []*ecdsa.PublicKey
+
+// verifySignature checks the manifest is signed by a trusted key, bundles do not need to be signed if no keys are trusted
+// As the manifest holds the checksums of the bundle's files, the signature covers all of them
+func verifySignature(dir string) error {
+	if len(trustedKeys) == 0 {
+		return nil
+	}
+
+	manifest, err := ioutil.ReadFile(path.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return RejectedError{"unsigned, no " + manifestName}
+	} else if err != nil {
+		return err
+	}
+
+	signature, err := ioutil.ReadFile(path.Join(dir, signatureName))
+	if os.IsNotExist(err) {
+		return RejectedError{"unsigned, no " + signatureName}
+	} else if err != nil {
+		return err
+	}
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return RejectedError{"malformed signature"}
+	}
+
+	hash := sha256.Sum256(manifest)
+	for _, key := range trustedKeys {
+		if ecdsa.Verify(key, hash[:], sig.R, sig.S) {
+			return nil
+		}
+	}
+
+	return RejectedError{"signature does not match a trusted key"}
+}
+
+// verifyComplete checks every file extracted from the bundle is listed in the manifest so that
+// a signed bundle can not carry unsigned files
+func verifyComplete(dir string, listed map[string]struct{}) error {
+	if len(trustedKeys) == 0 {
+		return nil
+	}
+
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case tarName, manifestName, signatureName:
+			return nil
+		}
+
+		if _, ok := listed[filepath.ToSlash(name)]; !ok {
+			return RejectedError{name + " is not listed in " + manifestName}
+		}
+
+		return nil
+	})
+}
+
+func parseKeys(keys string) ([]*ecdsa.PublicKey, error) {
+	var parsed []*ecdsa.PublicKey
+
+	rest := []byte(keys)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		ecdsaKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecdsaKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("Firmware public keys must be ECDSA P-256 keys")
+		}
+
+		parsed = append(parsed, ecdsaKey)
+	}
+
+	return parsed, nil
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -31,7 +32,7 @@ func GetHotspotDeleteDelay() (time.Duration, error) {
 	return time.Duration(value) * time.Second, err
 }
 
-// GetLoopDelay returns the time delay in seconds between each application process loop
+// GetLoopDelay returns the time delay in seconds between each full application process loop
 func GetLoopDelay() (time.Duration, error) {
 	value, err := strconv.Atoi(getEnv("ENM_CONFIG_LOOP_DELAY", "10"))
 	return time.Duration(value) * time.Second, err
@@ -43,6 +44,18 @@ func GetPauseDelay() (time.Duration, error) {
 	return time.Duration(value) * time.Second, err
 }
 
+// GetBackoffDelay returns the initial time delay in seconds before a failed device is processed again
+func GetBackoffDelay() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_BACKOFF_DELAY", "10"))
+	return time.Duration(value) * time.Second, err
+}
+
+// GetMaxBackoffDelay returns the maximum time delay in seconds before a repeatedly failing device is processed again
+func GetMaxBackoffDelay() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_BACKOFF_MAX_DELAY", "600"))
+	return time.Duration(value) * time.Second, err
+}
+
 // GetHotspotSSID returns the SSID to be used for the hotspot
 func GetHotspotSSID() string {
 	return getEnv("ENM_HOTSPOT_SSID", "resin-hotspot")
@@ -71,16 +84,68 @@ func GetAvahiTimeout() (time.Duration, error) {
 	return time.Duration(value) * time.Second, err
 }
 
+// GetIdentifyDuration returns the default time in seconds a device should identify itself for
+func GetIdentifyDuration() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_IDENTIFY_DURATION", "10"))
+	return time.Duration(value) * time.Second, err
+}
+
 // GetUpdateRetries returns the number of times the firmware update process should be attempted
 func GetUpdateRetries() (int, error) {
 	return strconv.Atoi(getEnv("ENM_UPDATE_RETRIES", "1"))
 }
 
+// GetUpdateProbation returns the time in seconds a device has to be seen after an update before it is rolled back
+func GetUpdateProbation() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_UPDATE_PROBATION", "60"))
+	return time.Duration(value) * time.Second, err
+}
+
+// GetUpdateBackoffDelay returns the initial time delay in seconds before a failed update to a commit is attempted again
+func GetUpdateBackoffDelay() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_UPDATE_BACKOFF_DELAY", "60"))
+	return time.Duration(value) * time.Second, err
+}
+
+// GetUpdateBackoffMaxDelay returns the maximum time delay in seconds before a repeatedly failing update to a commit is attempted again
+func GetUpdateBackoffMaxDelay() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_UPDATE_BACKOFF_MAX_DELAY", "3600"))
+	return time.Duration(value) * time.Second, err
+}
+
+// GetUpdateQuarantine returns the number of failed updates to a commit after which the update must be retried through the API
+func GetUpdateQuarantine() (int, error) {
+	return strconv.Atoi(getEnv("ENM_UPDATE_QUARANTINE", "5"))
+}
+
+// GetVersionCheckDelay returns the time delay in seconds between each check of the firmware version running on a device
+func GetVersionCheckDelay() (time.Duration, error) {
+	value, err := strconv.Atoi(getEnv("ENM_VERSION_CHECK_DELAY", "3600"))
+	return time.Duration(value) * time.Second, err
+}
+
+// GetDecommissionWipe returns whether devices should be sent a wipe command when they are decommissioned
+func GetDecommissionWipe() (bool, error) {
+	return strconv.ParseBool(getEnv("ENM_DECOMMISSION_WIPE", "false"))
+}
+
+// GetFirmwarePublicKeys returns the PEM encoded public keys trusted to sign firmware, firmware is not required to be signed if empty
+// Escaped newlines are accepted as environment variables can not always contain newlines
+func GetFirmwarePublicKeys() string {
+	return strings.Replace(getEnv("ENM_FIRMWARE_PUBLIC_KEYS", ""), "\\n", "\n", -1)
+}
+
 // GetAssetsDir returns the root directory used to store the database and application commits
 func GetAssetsDir() string {
 	return getEnv("ENM_ASSETS_DIRECTORY", "/data/assets")
 }
 
+// GetAssetsMaxSize returns the size in bytes above which unused firmware is removed from the assets directory
+func GetAssetsMaxSize() (int64, error) {
+	value, err := strconv.ParseInt(getEnv("ENM_ASSETS_MAX_SIZE", "100"), 10, 64)
+	return value * 1024 * 1024, err
+}
+
 // GetDbDir returns the directory used to store the database
 func GetDbDir() string {
 	return getEnv("ENM_DB_DIRECTORY", "/data/database")
@@ -3,25 +3,30 @@ package device
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/resin-io/edge-node-manager/board"
 	"github.com/resin-io/edge-node-manager/board/esp8266"
 	"github.com/resin-io/edge-node-manager/board/microbit"
 	"github.com/resin-io/edge-node-manager/board/nrf51822dk"
+	"github.com/resin-io/edge-node-manager/board/nrf52dk"
 	"github.com/resin-io/edge-node-manager/device/hook"
 	"github.com/resin-io/edge-node-manager/device/status"
 	"github.com/resin-io/edge-node-manager/micro/nrf51822"
+	"github.com/resin-io/edge-node-manager/micro/nrf52832"
 	"github.com/resin-io/edge-node-manager/supervisor"
 )
 
 type Device struct {
-	Board             board.Interface        `json:"-"`
-	ApplicationUUID   int                    `storm:"index"`
-	BoardType         board.Type             `storm:"index"`
-	Name              string                 `storm:"index"`
-	LocalUUID         string                 `storm:"index"`
-	ResinUUID         string                 `storm:"id,unique,index"`
-	Commit            string                 `storm:"index"`
+	Board             board.Interface `json:"-"`
+	ApplicationUUID   int             `storm:"index"`
+	BoardType         board.Type      `storm:"index"`
+	Name              string          `storm:"index"`
+	LocalUUID         string          `storm:"index"`
+	ResinUUID         string          `storm:"id,unique,index"`
+	Commit            string          `storm:"index"`
+	Version           string
+	VersionChecked    time.Time
 	TargetCommit      string                 `storm:"index"`
 	Status            status.Status          `storm:"index"`
 	Config            map[string]interface{} `storm:"index"`
@@ -30,6 +35,19 @@ type Device struct {
 	TargetEnvironment map[string]interface{} `storm:"index"`
 	RestartFlag       bool                   `storm:"index"`
 	DeleteFlag        bool                   `storm:"index"`
+	IdentifyFlag      bool                   `storm:"index"`
+	IdentifyDuration  time.Duration
+	Failures          int
+	BackoffUntil      time.Time
+}
+
+// Tombstone records a decommissioned device so that it is not provisioned again
+type Tombstone struct {
+	LocalUUID       string `storm:"id,unique,index"`
+	ApplicationUUID int    `storm:"index"`
+	ResinUUID       string `storm:"index"`
+	Name            string
+	Decommissioned  time.Time
 }
 
 func (d Device) String() string {
@@ -40,6 +58,7 @@ func (d Device) String() string {
 			"Local UUID: %s, "+
 			"Resin UUID: %s, "+
 			"Commit: %s, "+
+			"Version: %s, "+
 			"Target commit: %s, "+
 			"Status: %s, "+
 			"Config: %v, "+
@@ -47,13 +66,16 @@ func (d Device) String() string {
 			"Environment: %v, "+
 			"Target environment: %v, "+
 			"Restart: %t, "+
-			"Delete: %t",
+			"Delete: %t, "+
+			"Identify: %t, "+
+			"Failures: %d",
 		d.ApplicationUUID,
 		d.BoardType,
 		d.Name,
 		d.LocalUUID,
 		d.ResinUUID,
 		d.Commit,
+		d.Version,
 		d.TargetCommit,
 		d.Status,
 		d.Config,
@@ -61,7 +83,9 @@ func (d Device) String() string {
 		d.Environment,
 		d.TargetEnvironment,
 		d.RestartFlag,
-		d.DeleteFlag)
+		d.DeleteFlag,
+		d.IdentifyFlag,
+		d.Failures)
 }
 
 func New(applicationUUID int, boardType board.Type, name, localUUID, resinUUID string) Device {
@@ -89,6 +113,7 @@ func (d *Device) PopulateBoard() error {
 				LocalUUID:           d.LocalUUID,
 				Firmware:            nrf51822.FIRMWARE{},
 				NotificationChannel: make(chan []byte),
+				ReceiptInterval:     microbit.ReceiptInterval,
 			},
 		}
 	case board.NRF51822DK:
@@ -99,6 +124,18 @@ func (d *Device) PopulateBoard() error {
 				LocalUUID:           d.LocalUUID,
 				Firmware:            nrf51822.FIRMWARE{},
 				NotificationChannel: make(chan []byte),
+				ReceiptInterval:     nrf51822dk.ReceiptInterval,
+			},
+		}
+	case board.NRF52DK:
+		d.Board = nrf52dk.Nrf52dk{
+			Log: log,
+			Micro: nrf52832.Nrf52832{
+				Log:                 log,
+				LocalUUID:           d.LocalUUID,
+				Firmware:            nrf52832.FIRMWARE{},
+				NotificationChannel: make(chan []byte),
+				ReceiptInterval:     nrf52dk.ReceiptInterval,
 			},
 		}
 	case board.ESP8266:
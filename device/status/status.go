@@ -4,10 +4,13 @@ package status
 type Status string
 
 const (
-	DOWNLOADING Status = "Downloading"
-	INSTALLING         = "Installing"
-	STARTING           = "Starting"
-	STOPPING           = "Stopping"
-	IDLE               = "Idle"
-	OFFLINE            = "Offline"
+	DOWNLOADING    Status = "Downloading"
+	INSTALLING            = "Installing"
+	STARTING              = "Starting"
+	STOPPING              = "Stopping"
+	IDLE                  = "Idle"
+	OFFLINE               = "Offline"
+	PENDING_UPDATE        = "Pending update"
+	ROLLED_BACK           = "Rolled back"
+	UPDATE_FAILED         = "Update failed"
 )
@@ -0,0 +1,90 @@
+package update
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+// Phase defines the firmware update job phases
+type Phase string
+
+const (
+	DOWNLOADING  Phase = "Downloading"
+	TRANSFERRING       = "Transferring"
+	PROBATION          = "Probation"
+	INTERRUPTED        = "Interrupted"
+	ROLLED_BACK        = "Rolled back"
+	FAILED             = "Failed"
+	COMPLETE           = "Complete"
+)
+
+// Job records the progress of a firmware update so that it can be resumed if interrupted
+// There is one job per device, it is replaced when the device is updated to a new commit
+type Job struct {
+	ResinUUID         string `storm:"id,unique,index"`
+	ApplicationUUID   int    `storm:"index"`
+	TargetCommit      string `storm:"index"`
+	Phase             Phase  `storm:"index"`
+	BytesAcknowledged int
+	Size              int
+	Attempt           int
+	LastError         string
+	Failure           failure.Category
+	Failures          int
+	RetryAfter        time.Time
+	Quarantined       bool
+	Started           time.Time
+	Updated           time.Time
+}
+
+func (j Job) String() string {
+	return fmt.Sprintf(
+		"Resin UUID: %s, "+
+			"Target commit: %s, "+
+			"Phase: %s, "+
+			"Bytes acknowledged: %d, "+
+			"Size: %d, "+
+			"Attempt: %d, "+
+			"Last error: %s, "+
+			"Failure: %s, "+
+			"Failures: %d, "+
+			"Quarantined: %t",
+		j.ResinUUID,
+		j.TargetCommit,
+		j.Phase,
+		j.BytesAcknowledged,
+		j.Size,
+		j.Attempt,
+		j.LastError,
+		j.Failure,
+		j.Failures,
+		j.Quarantined)
+}
+
+func New(applicationUUID int, resinUUID, targetCommit string) Job {
+	return Job{
+		ResinUUID:       resinUUID,
+		ApplicationUUID: applicationUUID,
+		TargetCommit:    targetCommit,
+		Phase:           DOWNLOADING,
+		Started:         time.Now(),
+		Updated:         time.Now(),
+	}
+}
+
+// Active returns true if the job has not finished, the device may be left in its bootloader
+func (j Job) Active() bool {
+	return j.Phase != COMPLETE && j.Phase != ROLLED_BACK
+}
+
+// InFlight returns true if the job was part way through a phase when last saved
+func (j Job) InFlight() bool {
+	return j.Phase == DOWNLOADING || j.Phase == TRANSFERRING || j.Phase == PROBATION
+}
+
+// Held returns true if the job has failed and may not be retried yet, a quarantined job is only retried through the API
+func (j Job) Held(t time.Time) bool {
+	return j.Phase == FAILED && (j.Quarantined || t.Before(j.RetryAfter))
+}
@@ -0,0 +1,102 @@
+package failure
+
+import (
+	"context"
+	"fmt"
+)
+
+// Category defines how a failure affects retrying the operation which caused it
+type Category string
+
+const (
+	// TRANSIENT failures, such as radio timeouts, may not happen again if the operation is retried
+	TRANSIENT Category = "Transient"
+	// REJECTED failures are refused by the device, which will refuse the same firmware again
+	REJECTED = "Rejected"
+	// INCOMPATIBLE failures are caused by firmware which does not suit the device
+	INCOMPATIBLE = "Incompatible"
+	// CANCELLED failures are caused by the operation being stopped before it finished
+	CANCELLED = "Cancelled"
+)
+
+// Error is an error classified by its category
+type Error struct {
+	Category Category
+	Err      error
+}
+
+func (e Error) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error
+func (e Error) Cause() error {
+	return e.Err
+}
+
+// Classified is implemented by errors which know their category
+type Classified interface {
+	Category() Category
+}
+
+type causer interface {
+	Cause() error
+}
+
+func Transient(err error) error {
+	return Error{TRANSIENT, err}
+}
+
+func Transientf(format string, args ...interface{}) error {
+	return Transient(fmt.Errorf(format, args...))
+}
+
+func Rejected(err error) error {
+	return Error{REJECTED, err}
+}
+
+func Rejectedf(format string, args ...interface{}) error {
+	return Rejected(fmt.Errorf(format, args...))
+}
+
+func Incompatible(err error) error {
+	return Error{INCOMPATIBLE, err}
+}
+
+func Incompatiblef(format string, args ...interface{}) error {
+	return Incompatible(fmt.Errorf(format, args...))
+}
+
+func Cancelled(err error) error {
+	return Error{CANCELLED, err}
+}
+
+// Classify returns the category of the error, following wrapped errors to their cause
+// Errors which have not been classified are treated as transient
+func Classify(err error) Category {
+	for err != nil {
+		switch e := err.(type) {
+		case Error:
+			return e.Category
+		case Classified:
+			return e.Category()
+		}
+
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return CANCELLED
+		}
+
+		cause, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+
+	return TRANSIENT
+}
+
+// Retryable returns true if the operation may succeed if it is attempted again straight away
+func Retryable(err error) bool {
+	return Classify(err) == TRANSIENT
+}
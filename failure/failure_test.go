@@ -0,0 +1,76 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type wrapped struct {
+	err error
+}
+
+func (w wrapped) Error() string {
+	return "wrapped: " + w.err.Error()
+}
+
+func (w wrapped) Cause() error {
+	return w.err
+}
+
+type classified struct{}
+
+func (c classified) Error() string {
+	return "classified"
+}
+
+func (c classified) Category() Category {
+	return INCOMPATIBLE
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		category Category
+	}{
+		{"nil", nil, TRANSIENT},
+		{"unclassified", errors.New("timeout"), TRANSIENT},
+		{"transient", Transientf("timeout"), TRANSIENT},
+		{"rejected", Rejectedf("bad signature"), REJECTED},
+		{"incompatible", Incompatiblef("wrong board"), INCOMPATIBLE},
+		{"cancelled", Cancelled(errors.New("stopped")), CANCELLED},
+		{"context cancelled", context.Canceled, CANCELLED},
+		{"context deadline", context.DeadlineExceeded, CANCELLED},
+		{"classified", classified{}, INCOMPATIBLE},
+		{"wrapped rejected", wrapped{Rejectedf("bad signature")}, REJECTED},
+		{"wrapped context", wrapped{wrapped{context.Canceled}}, CANCELLED},
+		{"wrapped unclassified", wrapped{errors.New("timeout")}, TRANSIENT},
+		{"outermost category", Rejected(Incompatiblef("wrong board")), REJECTED},
+	}
+
+	for _, test := range tests {
+		if category := Classify(test.err); category != test.category {
+			t.Errorf("%s: Classify(%v) = %s, expected %s", test.name, test.err, category, test.category)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("timeout"), true},
+		{Transientf("timeout"), true},
+		{Rejectedf("bad signature"), false},
+		{Incompatiblef("wrong board"), false},
+		{context.Canceled, false},
+	}
+
+	for _, test := range tests {
+		if retryable := Retryable(test.err); retryable != test.retryable {
+			t.Errorf("Retryable(%v) = %t, expected %t", test.err, retryable, test.retryable)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"os"
-	"sort"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,9 +14,12 @@ import (
 	"github.com/jmoiron/jsonq"
 	"github.com/resin-io/edge-node-manager/api"
 	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/application/rollout"
 	"github.com/resin-io/edge-node-manager/config"
 	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/device/update"
 	"github.com/resin-io/edge-node-manager/process"
+	"github.com/resin-io/edge-node-manager/radio"
 	"github.com/resin-io/edge-node-manager/supervisor"
 )
 
@@ -34,12 +39,54 @@ func main() {
 
 	supervisor.WaitUntilReady()
 
-	for {
-		// Run processing loop
-		loop()
+	// Interrupted updates are resumed by the first loop
+	if err := process.Recover(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to recover interrupted updates")
+	}
+
+	// Stop processing cleanly when the container is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.WithFields(log.Fields{
+			"Signal": sig,
+		}).Info("Stopping edge-node-manager")
+		cancel()
+	}()
+
+	// Process every device at startup
+	loop(ctx, nil)
+	next := time.Now().Add(loopDelay)
 
-		// Delay between processing each set of applications to prevent 100% CPU usage
-		time.Sleep(loopDelay)
+	for {
+		select {
+		case <-ctx.Done():
+			if err := radio.Stop(); err != nil {
+				log.WithFields(log.Fields{
+					"Error": err,
+				}).Error("Unable to stop radios")
+			}
+			log.Info("Stopped edge-node-manager")
+			return
+		case <-process.Wake():
+			// Process the devices targeted by the supervisor hooks straight away
+			// A wake can outlive its requests if they were dequeued by the previous wake, an empty queue is not
+			// a request for a full loop so keep waiting
+			requests := process.Dequeue()
+			if len(requests) == 0 {
+				continue
+			}
+			loop(ctx, requests)
+		case <-time.After(next.Sub(time.Now())):
+			// Periodically process every device as a safety net
+			// The delay between each full loop also prevents 100% CPU usage
+			loop(ctx, nil)
+			next = time.Now().Add(loopDelay)
+		}
 	}
 }
 
@@ -77,6 +124,24 @@ func init() {
 		}).Fatal("Unable to initialise database")
 	}
 
+	if err := db.Init(&device.Tombstone{}); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to initialise database")
+	}
+
+	if err := db.Init(&update.Job{}); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to initialise database")
+	}
+
+	if err := db.Init(&rollout.Rollout{}); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to initialise database")
+	}
+
 	go func() {
 		router := api.NewRouter()
 		port := ":1337"
@@ -125,7 +190,8 @@ func checkVersion() error {
 	return nil
 }
 
-func loop() {
+// loop processes the devices targeted by the requests, or every device if requests is nil
+func loop(ctx context.Context, requests []process.Request) {
 	// Get applications from the supervisor
 	bytes, errs := supervisor.DependentApplicationsList()
 	if errs != nil {
@@ -144,19 +210,13 @@ func loop() {
 		return
 	}
 
-	// Sort applications to ensure they run in order
-	var keys []int
-	for key := range applications {
-		keys = append(keys, key)
-	}
-	sort.Ints(keys)
-
-	// Process applications
-	for _, key := range keys {
-		if errs := process.Run(applications[key]); errs != nil {
+	// Process applications, applications using different radios are processed concurrently
+	reports := process.Schedule(ctx, applications, requests)
+	for key, report := range reports {
+		if report.Failed() {
 			log.WithFields(log.Fields{
 				"Application": applications[key],
-				"Errors":      errs,
+				"Report":      report,
 			}).Error("Unable to process application")
 		}
 	}
@@ -0,0 +1,166 @@
+package maintenance
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Key is the application config or device config key holding the maintenance windows
+const Key = "ENM_MAINTENANCE_WINDOW"
+
+// Window is a time range on a set of weekdays, in the gateway's local time
+// A window whose end is before its start runs past midnight into the following day
+type Window struct {
+	Days  [7]bool
+	Start time.Duration
+	End   time.Duration
+}
+
+// Windows are the maintenance windows in which devices may be updated
+type Windows []Window
+
+var days = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse parses windows separated by semicolons, each of the form "[days] HH:MM-HH:MM"
+// Days are a comma separated list of weekdays or weekday ranges e.g. "Mon-Fri,Sun", every day if omitted
+// For example "Mon-Fri 22:00-06:00; Sat,Sun 00:00-24:00"
+func Parse(spec string) (Windows, error) {
+	var windows Windows
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		window, err := parseWindow(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window %q: %v", entry, err)
+		}
+
+		windows = append(windows, window)
+	}
+
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("No maintenance windows")
+	}
+
+	return windows, nil
+}
+
+// Open returns true if the time falls within any of the windows
+func (w Windows) Open(t time.Time) bool {
+	for _, window := range w {
+		if window.open(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w Window) open(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if w.Start <= w.End {
+		return w.Days[t.Weekday()] && offset >= w.Start && offset < w.End
+	}
+
+	// The window runs past midnight so it is open late on the listed days and early on the following days
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.Days[t.Weekday()] && offset >= w.Start) || (w.Days[yesterday] && offset < w.End)
+}
+
+func parseWindow(entry string) (Window, error) {
+	var window Window
+
+	fields := strings.Fields(entry)
+	var times string
+	switch len(fields) {
+	case 1:
+		for i := range window.Days {
+			window.Days[i] = true
+		}
+		times = fields[0]
+	case 2:
+		if err := parseDays(fields[0], &window.Days); err != nil {
+			return window, err
+		}
+		times = fields[1]
+	default:
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	bounds := strings.Split(times, "-")
+	if len(bounds) != 2 {
+		return window, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+
+	var err error
+	if window.Start, err = parseTime(bounds[0]); err != nil {
+		return window, err
+	}
+
+	if window.End, err = parseTime(bounds[1]); err != nil {
+		return window, err
+	}
+
+	if window.Start == window.End {
+		return window, fmt.Errorf("start and end are the same")
+	}
+
+	return window, nil
+}
+
+func parseDays(spec string, result *[7]bool) error {
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid days %q", part)
+		}
+
+		first, ok := days[strings.ToLower(bounds[0])]
+		if !ok {
+			return fmt.Errorf("invalid day %q", bounds[0])
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = days[strings.ToLower(bounds[1])]; !ok {
+				return fmt.Errorf("invalid day %q", bounds[1])
+			}
+		}
+
+		// Ranges may wrap around the end of the week e.g. Sat-Mon
+		for day := first; ; day = (day + 1) % 7 {
+			result[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseTime(spec string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(spec, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time %q", spec)
+	}
+
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", spec)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
@@ -0,0 +1,123 @@
+package maintenance
+
+import (
+	"testing"
+	"time"
+)
+
+// 2018-04-09 is a Monday
+func at(day, hour, minute int, loc *time.Location) time.Time {
+	return time.Date(2018, time.April, 9+day, hour, minute, 0, 0, loc)
+}
+
+func TestParse(t *testing.T) {
+	everyDay := [7]bool{true, true, true, true, true, true, true}
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+
+	tests := []struct {
+		spec    string
+		windows Windows
+		err     bool
+	}{
+		{"02:00-04:00", Windows{{everyDay, 2 * time.Hour, 4 * time.Hour}}, false},
+		{"Mon-Fri 22:00-06:00", Windows{{weekdays, 22 * time.Hour, 6 * time.Hour}}, false},
+		{"mon-fri 09:30-17:00", Windows{{weekdays, 9*time.Hour + 30*time.Minute, 17 * time.Hour}}, false},
+		{"Sat-Mon 00:00-24:00", Windows{{[7]bool{true, true, false, false, false, false, true}, 0, 24 * time.Hour}}, false},
+		{"Tue,Thu 01:00-02:00", Windows{{[7]bool{false, false, true, false, true, false, false}, time.Hour, 2 * time.Hour}}, false},
+		{
+			"Mon-Fri 22:00-06:00; Sat,Sun 00:00-24:00;",
+			Windows{
+				{weekdays, 22 * time.Hour, 6 * time.Hour},
+				{[7]bool{true, false, false, false, false, false, true}, 0, 24 * time.Hour},
+			},
+			false,
+		},
+		{"", nil, true},
+		{" ; ", nil, true},
+		{"02:00", nil, true},
+		{"02:00-04:00-06:00", nil, true},
+		{"Mon Tue 02:00-04:00", nil, true},
+		{"Funday 02:00-04:00", nil, true},
+		{"Mon-Tue-Wed 02:00-04:00", nil, true},
+		{"02:00-02:00", nil, true},
+		{"25:00-02:00", nil, true},
+		{"24:30-02:00", nil, true},
+		{"02:60-03:00", nil, true},
+		{"two-four", nil, true},
+	}
+
+	for _, test := range tests {
+		windows, err := Parse(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("Parse(%q) expected an error, got %v", test.spec, windows)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Parse(%q) unexpected error: %v", test.spec, err)
+			continue
+		}
+
+		if len(windows) != len(test.windows) {
+			t.Errorf("Parse(%q) = %v, expected %v", test.spec, windows, test.windows)
+			continue
+		}
+
+		for i := range windows {
+			if windows[i] != test.windows[i] {
+				t.Errorf("Parse(%q) = %v, expected %v", test.spec, windows, test.windows)
+				break
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		spec string
+		time time.Time
+		open bool
+	}{
+		{"02:00-04:00", at(0, 2, 0, time.UTC), true},
+		{"02:00-04:00", at(0, 3, 59, time.UTC), true},
+		{"02:00-04:00", at(0, 4, 0, time.UTC), false},
+		{"02:00-04:00", at(0, 1, 59, time.UTC), false},
+		{"Mon-Fri 09:00-17:00", at(4, 12, 0, time.UTC), true},
+		{"Mon-Fri 09:00-17:00", at(5, 12, 0, time.UTC), false},
+		{"Sat,Sun 00:00-24:00", at(6, 23, 59, time.UTC), true},
+		{"Sat,Sun 00:00-24:00", at(7, 0, 0, time.UTC), false},
+
+		// Windows crossing midnight are open late on the listed days and early on the following days
+		{"Mon-Fri 22:00-06:00", at(0, 23, 0, time.UTC), true},
+		{"Mon-Fri 22:00-06:00", at(1, 5, 59, time.UTC), true},
+		{"Mon-Fri 22:00-06:00", at(1, 6, 0, time.UTC), false},
+		{"Mon-Fri 22:00-06:00", at(0, 5, 0, time.UTC), false},
+		{"Mon-Fri 22:00-06:00", at(5, 5, 0, time.UTC), true},
+		{"Mon-Fri 22:00-06:00", at(5, 23, 0, time.UTC), false},
+		{"Sun 23:00-01:00", at(-1, 23, 30, time.UTC), true},
+		{"Sun 23:00-01:00", at(0, 0, 30, time.UTC), true},
+
+		// Windows are in the local time of the time being checked
+		{"02:00-04:00", at(0, 2, 0, time.UTC).In(time.FixedZone("UTC+2", 2*60*60)), false},
+		{"02:00-04:00", at(0, 0, 30, time.UTC).In(time.FixedZone("UTC+2", 2*60*60)), true},
+		{"Mon 22:00-23:00", at(1, 3, 0, time.UTC).In(time.FixedZone("UTC-5", -5*60*60)), true},
+		{"Mon 22:00-23:00", at(1, 3, 0, time.UTC), false},
+
+		{"Mon 01:00-02:00; Tue 01:00-02:00", at(1, 1, 30, time.UTC), true},
+		{"Mon 01:00-02:00; Tue 01:00-02:00", at(2, 1, 30, time.UTC), false},
+	}
+
+	for _, test := range tests {
+		windows, err := Parse(test.spec)
+		if err != nil {
+			t.Errorf("Parse(%q) unexpected error: %v", test.spec, err)
+			continue
+		}
+
+		if open := windows.Open(test.time); open != test.open {
+			t.Errorf("Parse(%q).Open(%s) = %t, expected %t", test.spec, test.time, open, test.open)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package nordic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+
+	"github.com/mholt/archiver"
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+// Firmware package info
+// https://infocenter.nordicsemi.com/index.jsp?topic=%2Fcom.nordic.infocenter.tools%2Fdita%2Ftools%2Fnrfutil%2Fnrfutil_pkg.html
+
+// ImageType defines the images a firmware package can contain, the values are those sent in the DFU start request
+type ImageType byte
+
+const (
+	SOFTDEVICE            ImageType = 0x01
+	BOOTLOADER                      = 0x02
+	SOFTDEVICE_BOOTLOADER           = 0x03
+	APPLICATION                     = 0x04
+)
+
+// Image is a firmware image and its init packet
+type Image struct {
+	Type           ImageType
+	Binary         []byte
+	Data           []byte
+	SoftdeviceSize int
+	BootloaderSize int
+}
+
+type manifest struct {
+	Manifest struct {
+		Application          *entry `json:"application"`
+		Softdevice           *entry `json:"softdevice"`
+		Bootloader           *entry `json:"bootloader"`
+		SoftdeviceBootloader *entry `json:"softdevice_bootloader"`
+	} `json:"manifest"`
+}
+
+// entry describes an image in the manifest, the sizes of a combined image are at the top level in legacy packages
+type entry struct {
+	BinFile        string `json:"bin_file"`
+	DatFile        string `json:"dat_file"`
+	SoftdeviceSize int    `json:"sd_size"`
+	BootloaderSize int    `json:"bl_size"`
+	Metadata       struct {
+		SoftdeviceSize int `json:"sd_size"`
+		BootloaderSize int `json:"bl_size"`
+	} `json:"info_read_only_metadata"`
+}
+
+// Extract unzips the application.zip firmware package and reads the images listed in its manifest.json
+// The images are returned in the order they must be flashed, the softdevice and bootloader before the application
+// The firmware does not suit the board if the package is not in the format the board expects
+func Extract(filePath string) ([]Image, error) {
+	if err := archiver.Zip.Open(path.Join(filePath, "application.zip"), filePath); err != nil {
+		return nil, failure.Incompatible(err)
+	}
+
+	bytes, err := ioutil.ReadFile(path.Join(filePath, "manifest.json"))
+	if err != nil {
+		return nil, failure.Incompatible(err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return nil, failure.Incompatible(err)
+	}
+
+	entries := []struct {
+		imageType ImageType
+		entry     *entry
+	}{
+		{SOFTDEVICE_BOOTLOADER, m.Manifest.SoftdeviceBootloader},
+		{SOFTDEVICE, m.Manifest.Softdevice},
+		{BOOTLOADER, m.Manifest.Bootloader},
+		{APPLICATION, m.Manifest.Application},
+	}
+
+	var images []Image
+	for _, value := range entries {
+		if value.entry == nil {
+			continue
+		}
+
+		image, err := read(filePath, value.imageType, *value.entry)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, image)
+	}
+
+	if len(images) == 0 {
+		return nil, failure.Incompatiblef("Manifest does not list any images")
+	}
+
+	return images, nil
+}
+
+func read(filePath string, imageType ImageType, e entry) (Image, error) {
+	image := Image{
+		Type: imageType,
+	}
+
+	var err error
+	if image.Binary, err = ioutil.ReadFile(path.Join(filePath, e.BinFile)); err != nil {
+		return image, failure.Incompatible(err)
+	}
+
+	if image.Data, err = ioutil.ReadFile(path.Join(filePath, e.DatFile)); err != nil {
+		return image, failure.Incompatible(err)
+	}
+
+	switch imageType {
+	case SOFTDEVICE:
+		image.SoftdeviceSize = len(image.Binary)
+	case BOOTLOADER:
+		image.BootloaderSize = len(image.Binary)
+	case SOFTDEVICE_BOOTLOADER:
+		image.SoftdeviceSize = e.SoftdeviceSize
+		image.BootloaderSize = e.BootloaderSize
+		if e.Metadata.SoftdeviceSize != 0 || e.Metadata.BootloaderSize != 0 {
+			image.SoftdeviceSize = e.Metadata.SoftdeviceSize
+			image.BootloaderSize = e.Metadata.BootloaderSize
+		}
+
+		// The bootloader needs the size of each part of a combined image
+		if image.SoftdeviceSize+image.BootloaderSize != len(image.Binary) {
+			return image, failure.Incompatiblef("Softdevice and bootloader sizes do not match the combined image")
+		}
+	}
+
+	return image, nil
+}
+
+// Sizes returns the softdevice, bootloader and application sizes sent in the DFU start packet
+func (i Image) Sizes() (int, int, int) {
+	if i.Type == APPLICATION {
+		return 0, 0, len(i.Binary)
+	}
+
+	return i.SoftdeviceSize, i.BootloaderSize, 0
+}
+
+func (i Image) String() string {
+	switch i.Type {
+	case SOFTDEVICE:
+		return "Softdevice"
+	case BOOTLOADER:
+		return "Bootloader"
+	case SOFTDEVICE_BOOTLOADER:
+		return "Softdevice and bootloader"
+	default:
+		return "Application"
+	}
+}
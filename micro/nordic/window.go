@@ -0,0 +1,54 @@
+package nordic
+
+import "sync"
+
+var (
+	windowMutex sync.Mutex
+	// windows holds the receipt interval which has worked for each device, it is reduced when a transfer falls out
+	// of sync and raised again towards the board's interval after each transfer which does not
+	windows = make(map[string]int)
+)
+
+// Window returns the number of packets to send between receipts for the device
+func Window(id string, interval int) int {
+	windowMutex.Lock()
+	defer windowMutex.Unlock()
+
+	// A receipt is needed for every packet if the board does not set an interval
+	if interval < 1 {
+		interval = 1
+	}
+
+	if window, ok := windows[id]; ok && window < interval {
+		return window
+	}
+
+	return interval
+}
+
+// Shrink halves the device's window after a transfer fell out of sync and returns the new window
+func Shrink(id string, window int) int {
+	windowMutex.Lock()
+	defer windowMutex.Unlock()
+
+	window /= 2
+	if window < 1 {
+		window = 1
+	}
+	windows[id] = window
+
+	return window
+}
+
+// Grow doubles the device's window after a transfer which stayed in sync, up to the board's interval
+func Grow(id string, window, interval int) {
+	windowMutex.Lock()
+	defer windowMutex.Unlock()
+
+	window *= 2
+	if window >= interval {
+		delete(windows, id)
+		return
+	}
+	windows[id] = window
+}
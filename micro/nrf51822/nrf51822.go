@@ -4,14 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io/ioutil"
-	"path"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/currantlabs/ble"
-	"github.com/mholt/archiver"
+	"github.com/resin-io/edge-node-manager/board"
 	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/failure"
+	"github.com/resin-io/edge-node-manager/micro/nordic"
 	"github.com/resin-io/edge-node-manager/radio/bluetooth"
 )
 
@@ -33,6 +33,15 @@ const (
 	BlockRecipt             = 0x11
 )
 
+// Response codes sent by the bootloader in reply to a request
+const (
+	InvalidState         byte = 0x02
+	NotSupported              = 0x03
+	DataSizeExceedsLimit      = 0x04
+	CRCError                  = 0x05
+	OperationFailed           = 0x06
+)
+
 // Nrf51822 is a BLE SoC from Nordic
 // https://www.nordicsemi.com/eng/Products/Bluetooth-low-energy/nRF51822
 type Nrf51822 struct {
@@ -40,13 +49,17 @@ type Nrf51822 struct {
 	LocalUUID           string
 	Firmware            FIRMWARE
 	NotificationChannel chan []byte
+	Progress            board.Progress
+	// ReceiptInterval is the number of packets the bootloader receives between receipts
+	ReceiptInterval int
+	packetSize      int
+	window          int
 }
 
 type FIRMWARE struct {
 	currentBlock int
 	size         int
-	binary       []byte
-	data         []byte
+	image        nordic.Image
 }
 
 var (
@@ -64,36 +77,31 @@ func (m *Nrf51822) CleanupRadio() error {
 	return bluetooth.Cleanup()
 }
 
-func (m *Nrf51822) ExtractFirmware(filePath, bin, data string) error {
+// ExtractFirmware reads the images listed in the firmware package's manifest, each image is flashed in turn
+func (m *Nrf51822) ExtractFirmware(filePath string) ([]FIRMWARE, error) {
 	m.Log.WithFields(log.Fields{
 		"Firmware path": filePath,
-		"Bin":           bin,
-		"Data":          data,
 	}).Debug("Extracting firmware")
 
-	var err error
-
-	if err = archiver.Zip.Open(path.Join(filePath, "application.zip"), filePath); err != nil {
-		return err
-	}
-
-	m.Firmware.binary, err = ioutil.ReadFile(path.Join(filePath, bin))
+	images, err := nordic.Extract(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	m.Firmware.data, err = ioutil.ReadFile(path.Join(filePath, data))
-	if err != nil {
-		return err
-	}
-
-	m.Firmware.size = len(m.Firmware.binary)
+	firmware := make([]FIRMWARE, len(images))
+	for i, image := range images {
+		firmware[i] = FIRMWARE{
+			size:  len(image.Binary),
+			image: image,
+		}
 
-	m.Log.WithFields(log.Fields{
-		"Size": m.Firmware.size,
-	}).Debug("Extracted firmware")
+		m.Log.WithFields(log.Fields{
+			"Image": image,
+			"Size":  firmware[i].size,
+		}).Debug("Extracted firmware")
+	}
 
-	return nil
+	return firmware, nil
 }
 
 func (m *Nrf51822) Update(client ble.Client) error {
@@ -102,6 +110,11 @@ func (m *Nrf51822) Update(client ble.Client) error {
 	}
 	defer client.ClearSubscriptions()
 
+	// Each write carries as much of the firmware as the negotiated MTU allows after the ATT header
+	m.packetSize = bluetooth.GetMTU(client) - 3
+	m.window = nordic.Window(m.LocalUUID, m.ReceiptInterval)
+
+	m.reportProgress(board.INITIALISE)
 	if err := m.checkFOTA(client); err != nil {
 		return err
 	}
@@ -110,6 +123,9 @@ func (m *Nrf51822) Update(client ble.Client) error {
 		if err := m.initFOTA(client); err != nil {
 			return err
 		}
+	} else if err := m.requestReceipts(client); err != nil {
+		// The receipt count is restarted so that it lines up with the packets sent from here
+		return err
 	}
 
 	if err := m.transferFOTA(client); err != nil {
@@ -123,6 +139,21 @@ func (m *Nrf51822) Update(client ble.Client) error {
 	return m.finaliseFOTA(client)
 }
 
+// Restart resets a device running the bootloader back into its application
+func (m *Nrf51822) Restart(client ble.Client) error {
+	m.Log.Debug("Restarting")
+
+	// Ignore the error because this command causes the device to disconnect
+	bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Restart}, false)
+
+	// Give the device time to disconnect
+	time.Sleep(shortTimeout)
+
+	m.Log.Debug("Restarted")
+
+	return nil
+}
+
 func init() {
 	log.SetLevel(config.GetLogLevel())
 
@@ -193,19 +224,21 @@ func (m *Nrf51822) checkFOTA(client ble.Client) error {
 }
 
 func (m *Nrf51822) initFOTA(client ble.Client) error {
-	m.Log.Debug("Initialising FOTA")
+	m.Log.WithFields(log.Fields{
+		"Image": m.Firmware.image,
+	}).Debug("Initialising FOTA")
 
-	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Start, 0x04}, false); err != nil {
+	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Start, (byte)(m.Firmware.image.Type)}, false); err != nil {
 		return err
 	}
 
+	// The start packet holds the softdevice, bootloader and application sizes
+	softdevice, bootloader, application := m.Firmware.image.Sizes()
 	buf := new(bytes.Buffer)
-	if _, err := buf.Write(make([]byte, 8)); err != nil {
-		return err
-	}
-
-	if err := binary.Write(buf, binary.LittleEndian, (int32)(m.Firmware.size)); err != nil {
-		return err
+	for _, size := range []int{softdevice, bootloader, application} {
+		if err := binary.Write(buf, binary.LittleEndian, (uint32)(size)); err != nil {
+			return err
+		}
 	}
 
 	if err := bluetooth.WriteCharacteristic(client, dfuPkt, buf.Bytes(), false); err != nil {
@@ -220,7 +253,7 @@ func (m *Nrf51822) initFOTA(client ble.Client) error {
 		return err
 	}
 
-	if err := bluetooth.WriteCharacteristic(client, dfuPkt, m.Firmware.data, false); err != nil {
+	if err := bluetooth.WriteCharacteristic(client, dfuPkt, m.Firmware.image.Data, false); err != nil {
 		return err
 	}
 
@@ -232,7 +265,7 @@ func (m *Nrf51822) initFOTA(client ble.Client) error {
 		return err
 	}
 
-	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{RequestBlockRecipt, 0x64, 0x00}, false); err != nil {
+	if err := m.requestReceipts(client); err != nil {
 		return err
 	}
 
@@ -245,50 +278,56 @@ func (m *Nrf51822) initFOTA(client ble.Client) error {
 	return nil
 }
 
+// transferFOTA sends the firmware a packet at a time, the bootloader sends a receipt every window packets
+// A transfer which falls out of sync fails and the window is reduced for the next attempt
 func (m *Nrf51822) transferFOTA(client ble.Client) error {
 	blockCounter := 1
-	blockSize := 20
-
-	if m.Firmware.currentBlock != 0 {
-		blockCounter += (m.Firmware.currentBlock / blockSize)
-	}
 
 	m.Log.WithFields(log.Fields{
-		"Progress %": m.getProgress(),
+		"Progress %":  m.getProgress(),
+		"Packet size": m.packetSize,
+		"Window":      m.window,
 	}).Info("Transferring FOTA")
+	m.reportProgress(board.TRANSFER)
 
-	for i := m.Firmware.currentBlock; i < m.Firmware.size; i += blockSize {
-		sliceIndex := i + blockSize
+	for i := m.Firmware.currentBlock; i < m.Firmware.size; i += m.packetSize {
+		sliceIndex := i + m.packetSize
 		if sliceIndex > m.Firmware.size {
 			sliceIndex = m.Firmware.size
 		}
-		block := m.Firmware.binary[i:sliceIndex]
+		block := m.Firmware.image.Binary[i:sliceIndex]
 
 		if err := bluetooth.WriteCharacteristic(client, dfuPkt, block, true); err != nil {
 			return err
 		}
 
-		if (blockCounter % 100) == 0 {
+		if (blockCounter % m.window) == 0 {
 			resp, err := m.getNotification(nil, false)
 			if err != nil {
 				return err
 			}
 
 			if resp[0] != BlockRecipt {
-				return fmt.Errorf("Incorrect notification received")
+				return failure.Transientf("Incorrect notification received")
 			}
 
 			if m.Firmware.currentBlock, err = unpack(resp[1:]); err != nil {
 				return err
 			}
 
-			if (i + blockSize) != m.Firmware.currentBlock {
-				return fmt.Errorf("FOTA transer out of sync")
+			if sliceIndex != m.Firmware.currentBlock {
+				window := nordic.Shrink(m.LocalUUID, m.window)
+				m.Log.WithFields(log.Fields{
+					"Window": window,
+				}).Warn("FOTA transfer out of sync")
+
+				return failure.Transientf("FOTA transfer out of sync")
 			}
 
 			m.Log.WithFields(log.Fields{
 				"Progress %": m.getProgress(),
 			}).Info("Transferring FOTA")
+			m.reportProgress(board.TRANSFER)
 		}
 
 		blockCounter++
@@ -298,6 +337,8 @@ func (m *Nrf51822) transferFOTA(client ble.Client) error {
 		return err
 	}
 
+	nordic.Grow(m.LocalUUID, m.window, m.ReceiptInterval)
+
 	m.Log.WithFields(log.Fields{
 		"Progress %": 100,
 	}).Info("Transferring FOTA")
@@ -307,14 +348,16 @@ func (m *Nrf51822) transferFOTA(client ble.Client) error {
 
 func (m *Nrf51822) validateFOTA(client ble.Client) error {
 	m.Log.Debug("Validating FOTA")
+	m.reportProgress(board.VALIDATE)
 
 	if err := m.checkFOTA(client); err != nil {
 		return err
 	}
 
 	if m.Firmware.currentBlock != m.Firmware.size {
-		return fmt.Errorf("Bytes received does not match binary size")
+		return failure.Transientf("Bytes received does not match binary size")
 	}
+	m.reportProgress(board.VALIDATE)
 
 	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Validate}, false); err != nil {
 		return err
@@ -331,6 +374,7 @@ func (m *Nrf51822) validateFOTA(client ble.Client) error {
 
 func (m Nrf51822) finaliseFOTA(client ble.Client) error {
 	m.Log.Debug("Finalising FOTA")
+	m.reportProgress(board.ACTIVATE)
 
 	// Ignore the error because this command causes the device to disconnect
 	bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Activate}, false)
@@ -343,10 +387,21 @@ func (m Nrf51822) finaliseFOTA(client ble.Client) error {
 	return nil
 }
 
+// requestReceipts asks the bootloader for a receipt every window packets, which also restarts its count
+func (m *Nrf51822) requestReceipts(client ble.Client) error {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(RequestBlockRecipt)
+	if err := binary.Write(buf, binary.LittleEndian, (uint16)(m.window)); err != nil {
+		return err
+	}
+
+	return bluetooth.WriteCharacteristic(client, dfuCtrl, buf.Bytes(), false)
+}
+
 func (m *Nrf51822) getNotification(exp []byte, compare bool) ([]byte, error) {
 	select {
 	case <-time.After(longTimeout):
-		return nil, fmt.Errorf("Timed out waiting for notification")
+		return nil, failure.Transientf("Timed out waiting for notification")
 	case resp := <-m.NotificationChannel:
 		if !compare || bytes.Equal(resp[:3], exp) {
 			return resp, nil
@@ -364,7 +419,25 @@ func (m *Nrf51822) getNotification(exp []byte, compare bool) ([]byte, error) {
 			"[2]": fmt.Sprintf("0x%X", exp[2]),
 		}).Debug("Expected")
 
-		return nil, fmt.Errorf("Incorrect notification received")
+		// The bootloader replies to a failed request with an error code in place of success
+		if resp[0] == Response && resp[1] == exp[1] {
+			return nil, responseError(resp[1], resp[2])
+		}
+
+		return nil, failure.Transientf("Incorrect notification received")
+	}
+}
+
+// responseError classifies the error code the bootloader replied to the request with
+func responseError(request, code byte) error {
+	switch code {
+	case NotSupported, DataSizeExceedsLimit:
+		return failure.Incompatiblef("Request 0x%X failed with response 0x%X", request, code)
+	case OperationFailed:
+		return failure.Rejectedf("Request 0x%X failed with response 0x%X", request, code)
+	default:
+		// Invalid state and CRC errors are caused by a transfer going wrong and may not happen again
+		return failure.Transientf("Request 0x%X failed with response 0x%X", request, code)
 	}
 }
 
@@ -372,6 +445,13 @@ func (m *Nrf51822) getProgress() float32 {
 	return ((float32)(m.Firmware.currentBlock) / (float32)(m.Firmware.size)) * 100.0
 }
 
+// reportProgress passes the step and the number of bytes acknowledged by the device to the progress callback
+func (m *Nrf51822) reportProgress(step board.Step) {
+	if m.Progress != nil {
+		m.Progress(step, m.Firmware.currentBlock, m.Firmware.size)
+	}
+}
+
 func unpack(resp []byte) (int, error) {
 	var result int32
 	buf := bytes.NewReader(resp)
@@ -0,0 +1,620 @@
+package nrf52832
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/currantlabs/ble"
+	"github.com/resin-io/edge-node-manager/board"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/failure"
+	"github.com/resin-io/edge-node-manager/micro/nordic"
+	"github.com/resin-io/edge-node-manager/radio/bluetooth"
+)
+
+// Secure firmware-over-the-air update info
+// https://infocenter.nordicsemi.com/index.jsp?topic=%2Fcom.nordic.infocenter.sdk5.v12.0.0%2Flib_dfu_transport_ble.html
+// https://infocenter.nordicsemi.com/index.jsp?topic=%2Fcom.nordic.infocenter.sdk5.v12.0.0%2Flib_dfu_transport.html
+
+// Control point opcodes
+const (
+	Create            byte = 0x01
+	SetReceipt             = 0x02
+	CalculateChecksum      = 0x03
+	Execute                = 0x04
+	Select                 = 0x06
+	Abort                  = 0x0C
+	Response               = 0x60
+)
+
+// Object types
+const (
+	Command byte = 0x01
+	Data         = 0x02
+)
+
+// Result codes sent by the bootloader in reply to a request
+const (
+	Success              byte = 0x01
+	OpcodeNotSupported        = 0x02
+	InvalidParameter          = 0x03
+	InsufficientResource      = 0x04
+	InvalidObject             = 0x05
+	UnsupportedType           = 0x07
+	NotPermitted              = 0x08
+	OperationFailed           = 0x0A
+	ExtendedError             = 0x0B
+)
+
+// Extended error codes sent by the bootloader after the extended error result code
+const (
+	WrongCommandFormat byte = 0x02
+	UnknownCommand          = 0x03
+	InitCommandInvalid      = 0x04
+	FirmwareVersion         = 0x05
+	HardwareVersion         = 0x06
+	SoftdeviceVersion       = 0x07
+	SignatureMissing        = 0x08
+	WrongHashType           = 0x09
+	HashFailed              = 0x0A
+	WrongSignatureType      = 0x0B
+	VerificationFailed      = 0x0C
+	InsufficientSpace       = 0x0D
+)
+
+// Nrf52832 is a BLE SoC from Nordic running the secure bootloader from nRF5 SDK 12 onwards
+// https://www.nordicsemi.com/eng/Products/Bluetooth-low-energy/nRF52832
+type Nrf52832 struct {
+	Log                 *log.Logger
+	LocalUUID           string
+	Firmware            FIRMWARE
+	NotificationChannel chan []byte
+	Progress            board.Progress
+	// ReceiptInterval is the number of packets the bootloader receives between receipts
+	ReceiptInterval int
+	packetSize      int
+	window          int
+}
+
+type FIRMWARE struct {
+	currentBlock int
+	size         int
+	image        nordic.Image
+}
+
+// object describes the state of the bootloader's current object of a type
+type object struct {
+	maxSize int
+	offset  int
+	crc     uint32
+}
+
+var (
+	errOutOfSync = failure.Transientf("FOTA transfer out of sync")
+	errChecksum  = failure.Transientf("FOTA transfer checksum mismatch")
+)
+
+var (
+	dfuPkt       *ble.Characteristic
+	dfuCtrl      *ble.Characteristic
+	shortTimeout time.Duration
+	longTimeout  time.Duration
+)
+
+func (m *Nrf52832) InitialiseRadio() error {
+	return bluetooth.Initialise()
+}
+
+func (m *Nrf52832) CleanupRadio() error {
+	return bluetooth.Cleanup()
+}
+
+// ExtractFirmware reads the images listed in the firmware package's manifest, each image is flashed in turn
+func (m *Nrf52832) ExtractFirmware(filePath string) ([]FIRMWARE, error) {
+	m.Log.WithFields(log.Fields{
+		"Firmware path": filePath,
+	}).Debug("Extracting firmware")
+
+	images, err := nordic.Extract(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	firmware := make([]FIRMWARE, len(images))
+	for i, image := range images {
+		firmware[i] = FIRMWARE{
+			size:  len(image.Binary),
+			image: image,
+		}
+
+		m.Log.WithFields(log.Fields{
+			"Image": image,
+			"Size":  firmware[i].size,
+		}).Debug("Extracted firmware")
+	}
+
+	return firmware, nil
+}
+
+// BootloaderUUID returns the address the bootloader advertises with, which is one more than the application's
+// address so that centrals do not use the application's cached services
+func (m *Nrf52832) BootloaderUUID() (string, error) {
+	parts := strings.Split(m.LocalUUID, ":")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("Invalid address %s", m.LocalUUID)
+	}
+
+	address := make([]byte, 6)
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return "", err
+		}
+		address[i] = (byte)(value)
+	}
+
+	// Only the least significant byte is incremented, it wraps without carrying
+	address[5]++
+
+	result := make([]string, 6)
+	for i, value := range address {
+		result[i] = fmt.Sprintf("%02x", value)
+	}
+
+	return strings.Join(result, ":"), nil
+}
+
+// Update transfers the init packet and then the firmware a data object at a time
+// An interrupted update is resumed if the bootloader still holds the init packet and the firmware sent so far
+func (m *Nrf52832) Update(client ble.Client) error {
+	if err := m.subscribe(client); err != nil {
+		return err
+	}
+	defer client.ClearSubscriptions()
+
+	// Each write carries as much of the firmware as the negotiated MTU allows after the ATT header
+	m.packetSize = bluetooth.GetMTU(client) - 3
+	m.window = nordic.Window(m.LocalUUID, m.ReceiptInterval)
+
+	m.reportProgress(board.INITIALISE)
+	if err := m.setReceipt(client); err != nil {
+		return err
+	}
+
+	command, data, err := m.checkFOTA(client)
+	if err != nil {
+		return err
+	}
+
+	if m.Firmware.currentBlock == 0 {
+		if err := m.initFOTA(client, command.maxSize); err != nil {
+			return err
+		}
+	}
+
+	return m.transferFOTA(client, data.maxSize)
+}
+
+// Restart aborts the update, which resets a device running the bootloader back into its application
+// Not every bootloader implements Abort, e.g. the SDK 12 bootloader, so the caller must check the application is
+// running again
+func (m *Nrf52832) Restart(client ble.Client) error {
+	m.Log.Debug("Restarting")
+
+	// Ignore the error because this command causes the device to disconnect
+	bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Abort}, false)
+
+	// Give the device time to disconnect
+	time.Sleep(shortTimeout)
+
+	m.Log.Debug("Restarted")
+
+	return nil
+}
+
+func init() {
+	log.SetLevel(config.GetLogLevel())
+
+	var err error
+	if shortTimeout, err = config.GetShortBluetoothTimeout(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load bluetooth timeout")
+	}
+
+	if longTimeout, err = config.GetLongBluetoothTimeout(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load bluetooth timeout")
+	}
+
+	dfuCtrl, err = bluetooth.GetCharacteristic("8ec90001f3154f609fb8838830daea50", ble.CharWrite+ble.CharNotify, 0x0F, 0x10)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	descriptor, err := bluetooth.GetDescriptor("2902", 0x11)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dfuCtrl.CCCD = descriptor
+
+	dfuPkt, err = bluetooth.GetCharacteristic("8ec90002f3154f609fb8838830daea50", ble.CharWriteNR, 0x0D, 0x0E)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Debug("Initialised nRF52832 characteristics")
+}
+
+func (m *Nrf52832) subscribe(client ble.Client) error {
+	if err := bluetooth.WriteDescriptor(client, dfuCtrl.CCCD, []byte{0x0001}); err != nil {
+		return err
+	}
+
+	return client.Subscribe(dfuCtrl, false, func(b []byte) {
+		m.NotificationChannel <- b
+	})
+}
+
+// setReceipt asks the bootloader for a receipt every window packets
+func (m *Nrf52832) setReceipt(client ble.Client) error {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(SetReceipt)
+	if err := binary.Write(buf, binary.LittleEndian, (uint16)(m.window)); err != nil {
+		return err
+	}
+
+	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, buf.Bytes(), false); err != nil {
+		return err
+	}
+
+	_, err := m.getResponse(SetReceipt)
+	return err
+}
+
+// checkFOTA finds how much of the firmware the bootloader already holds
+// The transfer is only resumed if the bootloader holds this firmware's init packet and the firmware sent so far
+// matches its checksum, otherwise it is started again
+func (m *Nrf52832) checkFOTA(client ble.Client) (object, object, error) {
+	m.Log.Debug("Checking FOTA")
+
+	m.Firmware.currentBlock = 0
+
+	command, err := m.selectObject(client, Command)
+	if err != nil {
+		return object{}, object{}, err
+	}
+
+	data, err := m.selectObject(client, Data)
+	if err != nil {
+		return object{}, object{}, err
+	}
+
+	if command.offset == len(m.Firmware.image.Data) &&
+		command.crc == crc32.ChecksumIEEE(m.Firmware.image.Data) &&
+		data.offset <= m.Firmware.size &&
+		data.crc == crc32.ChecksumIEEE(m.Firmware.image.Binary[:data.offset]) {
+		m.Firmware.currentBlock = data.offset
+	}
+
+	m.Log.WithFields(log.Fields{
+		"Start block": m.Firmware.currentBlock,
+	}).Debug("Checked FOTA")
+
+	return command, data, nil
+}
+
+// initFOTA sends the signed init packet, executing it starts a new transfer
+func (m *Nrf52832) initFOTA(client ble.Client, maxSize int) error {
+	m.Log.Debug("Initialising FOTA")
+
+	if len(m.Firmware.image.Data) > maxSize {
+		return failure.Incompatiblef("Init packet is larger than %d bytes", maxSize)
+	}
+
+	if err := m.createObject(client, Command, len(m.Firmware.image.Data)); err != nil {
+		return err
+	}
+
+	if err := m.writeObject(client, m.Firmware.image.Data, 0); err != nil {
+		return err
+	}
+
+	if err := m.executeObject(client); err != nil {
+		return err
+	}
+
+	m.Log.Debug("Initialised FOTA")
+
+	return nil
+}
+
+// transferFOTA sends the firmware a data object at a time, the bootloader validates the firmware once the last
+// object is executed and then activates it
+// An object which falls out of sync is created again and sent with a smaller window
+func (m *Nrf52832) transferFOTA(client ble.Client, maxSize int) error {
+	m.Log.WithFields(log.Fields{
+		"Progress %":  m.getProgress(),
+		"Packet size": m.packetSize,
+		"Window":      m.window,
+	}).Info("Transferring FOTA")
+	m.reportProgress(board.TRANSFER)
+
+	// A resumed transfer may stop at a complete object which was not executed before the update was interrupted,
+	// it is executed before continuing as nrfutil does. Executing an object which was already executed is refused,
+	// which only matters for the last object as the firmware is not activated until it is executed
+	if m.Firmware.currentBlock > 0 && (m.Firmware.currentBlock%maxSize == 0 || m.Firmware.currentBlock == m.Firmware.size) {
+		last := m.Firmware.currentBlock == m.Firmware.size
+		if last {
+			m.Log.Debug("Validating FOTA")
+			m.reportProgress(board.VALIDATE)
+		}
+
+		if err := m.executeObject(client); err != nil {
+			if last || !failure.Retryable(err) {
+				return err
+			}
+
+			m.Log.WithFields(log.Fields{
+				"Error": err,
+			}).Debug("Object already executed")
+		}
+	}
+
+	for m.Firmware.currentBlock < m.Firmware.size {
+		start := m.Firmware.currentBlock - (m.Firmware.currentBlock % maxSize)
+		end := start + maxSize
+		if end > m.Firmware.size {
+			end = m.Firmware.size
+		}
+
+		// A partly sent object is completed rather than created again
+		if m.Firmware.currentBlock == start {
+			if err := m.createObject(client, Data, end-start); err != nil {
+				return err
+			}
+		}
+
+		if err := m.writeObject(client, m.Firmware.image.Binary[:end], m.Firmware.currentBlock); err != nil {
+			if (err != errOutOfSync && err != errChecksum) || m.window == 1 {
+				return err
+			}
+
+			m.window = nordic.Shrink(m.LocalUUID, m.window)
+			m.Log.WithFields(log.Fields{
+				"Error":  err,
+				"Window": m.window,
+			}).Warn("Sending object again")
+
+			// Creating the object again discards what the bootloader received of it
+			m.drain()
+			if err := m.setReceipt(client); err != nil {
+				return err
+			}
+			m.Firmware.currentBlock = start
+			continue
+		}
+
+		if end == m.Firmware.size {
+			m.Log.Debug("Validating FOTA")
+			m.reportProgress(board.VALIDATE)
+		}
+
+		if err := m.executeObject(client); err != nil {
+			return err
+		}
+
+		m.Firmware.currentBlock = end
+
+		m.Log.WithFields(log.Fields{
+			"Progress %": m.getProgress(),
+		}).Info("Transferring FOTA")
+		m.reportProgress(board.TRANSFER)
+	}
+
+	nordic.Grow(m.LocalUUID, m.window, m.ReceiptInterval)
+
+	// The bootloader activates the firmware and resets once the last object is executed
+	m.Log.Debug("Finalising FOTA")
+	m.reportProgress(board.ACTIVATE)
+
+	// Give the device time to disconnect
+	time.Sleep(shortTimeout)
+
+	m.Log.Debug("Finalised FOTA")
+
+	return nil
+}
+
+func (m *Nrf52832) selectObject(client ble.Client, objectType byte) (object, error) {
+	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Select, objectType}, false); err != nil {
+		return object{}, err
+	}
+
+	resp, err := m.getResponse(Select)
+	if err != nil {
+		return object{}, err
+	}
+
+	var result struct {
+		MaxSize uint32
+		Offset  uint32
+		CRC     uint32
+	}
+	if err := binary.Read(bytes.NewReader(resp), binary.LittleEndian, &result); err != nil {
+		return object{}, failure.Transient(err)
+	}
+
+	return object{
+		maxSize: (int)(result.MaxSize),
+		offset:  (int)(result.Offset),
+		crc:     result.CRC,
+	}, nil
+}
+
+func (m *Nrf52832) createObject(client ble.Client, objectType byte, size int) error {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{Create, objectType})
+	if err := binary.Write(buf, binary.LittleEndian, (uint32)(size)); err != nil {
+		return err
+	}
+
+	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, buf.Bytes(), false); err != nil {
+		return err
+	}
+
+	_, err := m.getResponse(Create)
+	return err
+}
+
+// writeObject sends the payload from the offset to the current object in packets
+// The bootloader acknowledges every receipt interval packets with the offset and checksum of everything received
+func (m *Nrf52832) writeObject(client ble.Client, payload []byte, offset int) error {
+	packetCounter := 1
+
+	for i := offset; i < len(payload); i += m.packetSize {
+		sliceIndex := i + m.packetSize
+		if sliceIndex > len(payload) {
+			sliceIndex = len(payload)
+		}
+
+		if err := bluetooth.WriteCharacteristic(client, dfuPkt, payload[i:sliceIndex], true); err != nil {
+			return err
+		}
+
+		if (packetCounter % m.window) == 0 {
+			resp, err := m.getResponse(CalculateChecksum)
+			if err != nil {
+				return err
+			}
+
+			if err := checkReceipt(resp, payload[:sliceIndex]); err != nil {
+				return err
+			}
+		}
+
+		packetCounter++
+	}
+
+	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{CalculateChecksum}, false); err != nil {
+		return err
+	}
+
+	resp, err := m.getResponse(CalculateChecksum)
+	if err != nil {
+		return err
+	}
+
+	return checkReceipt(resp, payload)
+}
+
+func (m *Nrf52832) executeObject(client ble.Client) error {
+	if err := bluetooth.WriteCharacteristic(client, dfuCtrl, []byte{Execute}, false); err != nil {
+		return err
+	}
+
+	_, err := m.getResponse(Execute)
+	return err
+}
+
+// getResponse waits for the bootloader's response to the request and returns the payload after the result code
+func (m *Nrf52832) getResponse(request byte) ([]byte, error) {
+	select {
+	case <-time.After(longTimeout):
+		return nil, failure.Transientf("Timed out waiting for notification")
+	case resp := <-m.NotificationChannel:
+		if len(resp) < 3 || resp[0] != Response || resp[1] != request {
+			m.Log.WithFields(log.Fields{
+				"Response": fmt.Sprintf("% X", resp),
+				"Request":  fmt.Sprintf("0x%X", request),
+			}).Debug("Incorrect notification received")
+
+			return nil, failure.Transientf("Incorrect notification received")
+		}
+
+		if resp[2] != Success {
+			var extended byte
+			if resp[2] == ExtendedError && len(resp) > 3 {
+				extended = resp[3]
+			}
+			return nil, responseError(request, resp[2], extended)
+		}
+
+		return resp[3:], nil
+	}
+}
+
+// drain discards the receipts still on their way from a transfer which fell out of sync
+func (m *Nrf52832) drain() {
+	for {
+		select {
+		case <-time.After(shortTimeout):
+			return
+		case <-m.NotificationChannel:
+		}
+	}
+}
+
+// checkReceipt checks the offset and checksum the bootloader acknowledged against the payload sent so far
+func checkReceipt(resp, payload []byte) error {
+	var receipt struct {
+		Offset uint32
+		CRC    uint32
+	}
+	if err := binary.Read(bytes.NewReader(resp), binary.LittleEndian, &receipt); err != nil {
+		return failure.Transient(err)
+	}
+
+	if (int)(receipt.Offset) != len(payload) {
+		return errOutOfSync
+	}
+
+	if receipt.CRC != crc32.ChecksumIEEE(payload) {
+		return errChecksum
+	}
+
+	return nil
+}
+
+// responseError classifies the result code the bootloader replied to the request with
+func responseError(request, code, extended byte) error {
+	if code == ExtendedError {
+		switch extended {
+		case SignatureMissing, HashFailed, VerificationFailed:
+			return failure.Rejectedf("Request 0x%X failed with extended error 0x%X", request, extended)
+		case WrongCommandFormat, UnknownCommand, InitCommandInvalid, FirmwareVersion, HardwareVersion,
+			SoftdeviceVersion, WrongHashType, WrongSignatureType, InsufficientSpace:
+			return failure.Incompatiblef("Request 0x%X failed with extended error 0x%X", request, extended)
+		default:
+			return failure.Transientf("Request 0x%X failed with extended error 0x%X", request, extended)
+		}
+	}
+
+	switch code {
+	case OpcodeNotSupported, InvalidParameter, InsufficientResource, UnsupportedType:
+		return failure.Incompatiblef("Request 0x%X failed with response 0x%X", request, code)
+	case OperationFailed:
+		return failure.Rejectedf("Request 0x%X failed with response 0x%X", request, code)
+	default:
+		// Invalid objects and requests which are not permitted are caused by a transfer going wrong
+		return failure.Transientf("Request 0x%X failed with response 0x%X", request, code)
+	}
+}
+
+func (m *Nrf52832) getProgress() float32 {
+	return ((float32)(m.Firmware.currentBlock) / (float32)(m.Firmware.size)) * 100.0
+}
+
+// reportProgress passes the step and the number of bytes acknowledged by the device to the progress callback
+func (m *Nrf52832) reportProgress(step board.Step) {
+	if m.Progress != nil {
+		m.Progress(step, m.Firmware.currentBlock, m.Firmware.size)
+	}
+}
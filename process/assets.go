@@ -0,0 +1,74 @@
+package process
+
+import (
+	"github.com/asdine/storm"
+	"github.com/resin-io/edge-node-manager/application/rollout"
+	"github.com/resin-io/edge-node-manager/bundle"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/device"
+)
+
+// AssetsUsage returns the firmware cache usage
+func AssetsUsage() (bundle.Usage, error) {
+	referenced, err := getReferencedBundles()
+	if err != nil {
+		return bundle.Usage{}, err
+	}
+
+	return bundle.GetUsage(referenced)
+}
+
+// collectAssets removes unused firmware from the cache once it exceeds its max size
+func collectAssets() error {
+	referenced, err := getReferencedBundles()
+	if err != nil {
+		return err
+	}
+
+	return bundle.Collect(referenced)
+}
+
+// getReferencedBundles returns the firmware currently used or targeted by any device or application,
+// or being prefetched for an application
+func getReferencedBundles() (map[string]struct{}, error) {
+	referenced, err := getTargetedBundles()
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range getPrefetchingBundles() {
+		referenced[key] = struct{}{}
+	}
+
+	return referenced, nil
+}
+
+// getTargetedBundles returns the firmware currently used or targeted by any device or application's rollout
+func getTargetedBundles() (map[string]struct{}, error) {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var devices []device.Device
+	if err := db.All(&devices); err != nil {
+		return nil, err
+	}
+
+	var rollouts []rollout.Rollout
+	if err := db.All(&rollouts); err != nil {
+		return nil, err
+	}
+
+	targeted := make(map[string]struct{})
+	for _, value := range devices {
+		targeted[bundle.Key(value.ApplicationUUID, value.Commit)] = struct{}{}
+		targeted[bundle.Key(value.ApplicationUUID, value.TargetCommit)] = struct{}{}
+	}
+	for _, value := range rollouts {
+		targeted[bundle.Key(value.ApplicationUUID, value.TargetCommit)] = struct{}{}
+	}
+
+	return targeted, nil
+}
@@ -0,0 +1,78 @@
+package process
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/bundle"
+)
+
+var (
+	downloadMutex sync.Mutex
+	downloadID    int
+	// downloads holds the cancel functions of the firmware downloads in progress by bundle key
+	downloads = make(map[string]map[int]context.CancelFunc)
+)
+
+// getFirmware returns the directory holding the commit's firmware, downloading it if not already cached
+// The download is cancelled by cancelStaleDownloads once the commit is no longer used or targeted
+func getFirmware(ctx context.Context, applicationUUID int, commit string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	key := bundle.Key(applicationUUID, commit)
+
+	downloadMutex.Lock()
+	downloadID++
+	id := downloadID
+	if downloads[key] == nil {
+		downloads[key] = make(map[int]context.CancelFunc)
+	}
+	downloads[key][id] = cancel
+	downloadMutex.Unlock()
+
+	defer func() {
+		downloadMutex.Lock()
+		delete(downloads[key], id)
+		if len(downloads[key]) == 0 {
+			delete(downloads, key)
+		}
+		downloadMutex.Unlock()
+	}()
+
+	return bundle.Get(ctx, applicationUUID, commit)
+}
+
+// cancelStaleDownloads cancels the firmware downloads for commits which are no longer used or targeted by any
+// device or application, the partial downloads are removed by the next garbage collection
+// Prefetches are cancelled too, the prefetch itself does not keep its commit targeted
+func cancelStaleDownloads(applications map[int]application.Application) error {
+	referenced, err := getTargetedBundles()
+	if err != nil {
+		return err
+	}
+	for _, a := range applications {
+		referenced[bundle.Key(a.ResinUUID, a.TargetCommit)] = struct{}{}
+	}
+
+	downloadMutex.Lock()
+	defer downloadMutex.Unlock()
+
+	for key, cancels := range downloads {
+		if _, ok := referenced[key]; ok {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"Firmware": key,
+		}).Info("Cancelling firmware download, the commit is no longer targeted")
+
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package process
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/index"
+	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/device/update"
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+// Recover marks the update jobs which were in flight when the edge-node-manager stopped as interrupted
+// The interrupted jobs are resumed, or restarted if the device has lost its progress, by the next loop
+func Recover() error {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var jobs []update.Job
+	if err := db.All(&jobs); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if !job.InFlight() {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"Resin UUID":         job.ResinUUID,
+			"Target commit":      job.TargetCommit,
+			"Phase":              job.Phase,
+			"Bytes acknowledged": job.BytesAcknowledged,
+			"Size":               job.Size,
+			"Attempt":            job.Attempt,
+		}).Warn("Update interrupted")
+
+		job.Phase = update.INTERRUPTED
+		job.LastError = "Interrupted"
+		job.Failure = failure.CANCELLED
+		job.Updated = time.Now()
+		if err := db.Save(&job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RetryUpdate clears the failures of the device's failed update so that it is attempted again straight away,
+// returning false if the device has no failed update to retry
+func RetryUpdate(d device.Device) (bool, error) {
+	job, err := getJob(d)
+	if err != nil || job == nil || job.Phase != update.FAILED {
+		return false, err
+	}
+
+	log.WithFields(log.Fields{
+		"Resin UUID":    job.ResinUUID,
+		"Target commit": job.TargetCommit,
+		"Failures":      job.Failures,
+		"Quarantined":   job.Quarantined,
+	}).Info("Retrying update")
+
+	// Save the whole job as storm ignores zero values when updating
+	job.Failures = 0
+	job.RetryAfter = time.Time{}
+	job.Quarantined = false
+
+	return true, saveJob(job)
+}
+
+// getJob returns the update job for the device, or nil if the device has never been updated
+func getJob(d device.Device) (*update.Job, error) {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var job update.Job
+	if err := db.One("ResinUUID", d.ResinUUID, &job); err != nil {
+		if err.Error() == index.ErrNotFound.Error() {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// getJobs returns the application's update jobs keyed by resin UUID
+func getJobs(a application.Application) (map[string]update.Job, error) {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var jobs []update.Job
+	if err := db.Find("ApplicationUUID", a.ResinUUID, &jobs); err != nil && err.Error() != index.ErrNotFound.Error() {
+		return nil, err
+	}
+
+	result := make(map[string]update.Job)
+	for _, job := range jobs {
+		result[job.ResinUUID] = job
+	}
+
+	return result, nil
+}
+
+func saveJob(job *update.Job) error {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	job.Updated = time.Now()
+
+	return db.Save(job)
+}
+
+func deleteJob(d device.Device) error {
+	job, err := getJob(d)
+	if err != nil || job == nil {
+		return err
+	}
+
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.DeleteStruct(job)
+}
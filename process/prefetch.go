@@ -0,0 +1,200 @@
+package process
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/index"
+	"github.com/asdine/storm/q"
+	"github.com/resin-io/edge-node-manager/bundle"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/device/update"
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+var (
+	prefetchMutex sync.Mutex
+	// prefetches holds the firmware being downloaded in the background, it is removed once the download finishes
+	prefetches = make(map[string]struct{})
+	// prefetchFailures holds the firmware which failed to prefetch, it is not prefetched again until its backoff passes
+	prefetchFailures = make(map[string]prefetchFailure)
+)
+
+// prefetchFailure records the consecutive failures to prefetch the firmware for a commit
+type prefetchFailure struct {
+	failures   int
+	retryAfter time.Time
+}
+
+// Prefetch downloads the firmware for the commit in the background so that devices are updated from the cache
+// It returns straight away, firmware which is already cached or downloading is skipped
+// A failed prefetch is backed off exponentially and firmware which a device has refused or has been quarantined for is
+// not prefetched, it is downloaded by the update if it is retried
+// Once downloaded the devices targeting the commit are processed straight away
+func Prefetch(applicationUUID int, commit string) {
+	if commit == "" {
+		return
+	}
+
+	key := bundle.Key(applicationUUID, commit)
+
+	refused, err := refusedCommit(applicationUUID, commit)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Application": applicationUUID,
+			"Commit":      commit,
+			"Error":       err,
+		}).Error("Unable to get update jobs")
+		return
+	} else if refused {
+		return
+	}
+
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	if _, ok := prefetches[key]; ok {
+		return
+	}
+
+	if f, ok := prefetchFailures[key]; ok && time.Now().Before(f.retryAfter) {
+		return
+	}
+
+	// Cached firmware is verified before it is used so there is nothing to download
+	if bundle.Cached(applicationUUID, commit) {
+		return
+	}
+	prefetches[key] = struct{}{}
+
+	go func() {
+		log.WithFields(log.Fields{
+			"Application": applicationUUID,
+			"Commit":      commit,
+		}).Info("Prefetching firmware")
+
+		start := time.Now()
+		_, err := getFirmware(context.Background(), applicationUUID, commit)
+
+		// A failed prefetch is tried again when the commit is next seen once its backoff has passed
+		prefetchMutex.Lock()
+		delete(prefetches, key)
+		failed := prefetchFailures[key]
+		if err != nil {
+			failed.failures++
+			failed.retryAfter = time.Now().Add(backoff(failed.failures, updateBackoff, maxUpdateBackoff))
+			prefetchFailures[key] = failed
+		} else {
+			delete(prefetchFailures, key)
+		}
+		prefetchMutex.Unlock()
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Application": applicationUUID,
+				"Commit":      commit,
+				"Failures":    failed.failures,
+				"Retry after": failed.retryAfter,
+				"Error":       err,
+			}).Error("Unable to prefetch firmware")
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"Application": applicationUUID,
+			"Commit":      commit,
+			"Duration":    time.Since(start),
+		}).Info("Prefetched firmware")
+
+		if err := enqueueOutdated(applicationUUID, commit); err != nil {
+			log.WithFields(log.Fields{
+				"Application": applicationUUID,
+				"Error":       err,
+			}).Error("Unable to process devices waiting for firmware")
+		}
+	}()
+}
+
+// downloading returns true if the firmware for the commit is being prefetched
+func downloading(applicationUUID int, commit string) bool {
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	_, ok := prefetches[bundle.Key(applicationUUID, commit)]
+	return ok
+}
+
+// getPrefetchingBundles returns the firmware being prefetched
+// Once downloaded the firmware is only kept whilst a device or rollout references its commit
+func getPrefetchingBundles() map[string]struct{} {
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	prefetching := make(map[string]struct{})
+	for key := range prefetches {
+		prefetching[key] = struct{}{}
+	}
+
+	return prefetching
+}
+
+// refusedCommit returns true if a device's update to the commit failed because the firmware was rejected or is
+// incompatible, or has been quarantined
+func refusedCommit(applicationUUID int, commit string) (bool, error) {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var jobs []update.Job
+	err = db.Select(q.Eq("ApplicationUUID", applicationUUID), q.Eq("TargetCommit", commit)).Find(&jobs)
+	if err != nil && err.Error() != index.ErrNotFound.Error() {
+		return false, err
+	}
+
+	for _, job := range jobs {
+		if job.Phase != update.FAILED {
+			continue
+		}
+
+		if job.Quarantined || job.Failure == failure.REJECTED || job.Failure == failure.INCOMPATIBLE {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// enqueueOutdated wakes the processor to update the devices targeting the commit
+func enqueueOutdated(applicationUUID int, commit string) error {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+
+	var devices []device.Device
+	err = db.Select(q.Eq("ApplicationUUID", applicationUUID), q.Eq("TargetCommit", commit)).Find(&devices)
+	db.Close()
+	if err != nil && err.Error() != index.ErrNotFound.Error() {
+		return err
+	}
+
+	for _, value := range devices {
+		if value.Commit == commit {
+			continue
+		}
+
+		Enqueue(Request{
+			ApplicationUUID: value.ApplicationUUID,
+			ResinUUID:       value.ResinUUID,
+			Reason:          "Prefetched",
+		})
+	}
+
+	return nil
+}
@@ -1,45 +1,82 @@
 package process
 
 import (
-	"os"
-	"path"
-	"strconv"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/asdine/storm"
 	"github.com/asdine/storm/index"
 	"github.com/asdine/storm/q"
-	"github.com/fredli74/lockfile"
 	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/board"
+	"github.com/resin-io/edge-node-manager/bundle"
 	"github.com/resin-io/edge-node-manager/config"
 	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/device/hook"
 	deviceStatus "github.com/resin-io/edge-node-manager/device/status"
+	"github.com/resin-io/edge-node-manager/device/update"
+	"github.com/resin-io/edge-node-manager/failure"
+	"github.com/resin-io/edge-node-manager/maintenance"
 	processStatus "github.com/resin-io/edge-node-manager/process/status"
+	"github.com/resin-io/edge-node-manager/radio"
 	"github.com/resin-io/edge-node-manager/supervisor"
-	tarinator "github.com/verybluebot/tarinator-go"
 )
 
 var (
-	CurrentStatus processStatus.Status
-	TargetStatus  processStatus.Status
-	updateRetries int
-	pauseDelay    time.Duration
-	lockLocation  string
-	lock          *lockfile.LockFile
+	CurrentStatus     processStatus.Status
+	TargetStatus      processStatus.Status
+	updateRetries     int
+	updateProbation   time.Duration
+	updateBackoff     time.Duration
+	maxUpdateBackoff  time.Duration
+	updateQuarantine  int
+	versionCheckDelay time.Duration
+	wipe              bool
+	pauseDelay        time.Duration
+	backoffDelay      time.Duration
+	maxBackoffDelay   time.Duration
+	lockLocation      string
 )
 
-func Run(a application.Application) []error {
-	log.Info("----------------------------------------")
+// Run processes an application, errors are collected per device so that one failing
+// device does not stop the rest of the application's devices from being processed
+// Run should only be called by Schedule, which handles pausing and update locking
+// If targets is not nil only the targeted devices are processed, ignoring any backoff
+// Cancelling the context stops the remaining devices from being processed
+func Run(ctx context.Context, a application.Application, targets map[string]struct{}) *Report {
+	report := newReport(a)
+
+	// processed returns true if the device should be processed this loop
+	processed := func(d device.Device) bool {
+		if targets == nil {
+			return !backingOff(d)
+		}
+		_, ok := targets[d.ResinUUID]
+		return ok
+	}
 
-	// Pause the process if necessary
-	if err := pause(); err != nil {
-		return []error{err}
+	// skip returns true if processing has been cancelled, the device has already failed this loop
+	// or the device should not be processed this loop
+	skip := func(d device.Device) bool {
+		return ctx.Err() != nil || report.failed(d) || !processed(d)
 	}
 
+	// Wait until no other application is using the radio
+	release, err := radio.Acquire(ctx, a.Board.Radio())
+	if err != nil {
+		return report.fail(err)
+	}
+	defer release()
+
+	log.Info("----------------------------------------")
+
 	// Initialise the radio
 	if err := a.Board.InitialiseRadio(); err != nil {
-		return []error{err}
+		return report.fail(err)
 	}
 	defer a.Board.CleanupRadio()
 
@@ -53,29 +90,21 @@ func Run(a application.Application) []error {
 		}).Info("Processing application")
 	}
 
-	// Enable update locking
-	var err error
-	lock, err = lockfile.Lock(lockLocation)
-	if err != nil {
-		return []error{err}
-	}
-	defer lock.Unlock()
-
-	// Handle delete flags
-	if err := handleDelete(a); err != nil {
-		return []error{err}
+	// Decommission devices flagged for deletion
+	if err := handleDelete(a, report); err != nil {
+		return report.fail(err)
 	}
 
 	// Get all online devices associated with this application
 	onlineDevices, err := getOnlineDevices(a)
 	if err != nil {
-		return []error{err}
+		return report.fail(err)
 	}
 
 	// Get all provisioned devices associated with this application
 	provisionedDevices, err := getProvisionedDevices(a)
 	if err != nil {
-		return []error{err}
+		return report.fail(err)
 	}
 
 	if log.GetLevel() == log.DebugLevel {
@@ -88,88 +117,347 @@ func Run(a application.Application) []error {
 		}).Info("Processing application")
 	}
 
-	// Convert provisioned devices to a hash map
+	// Get all decommissioned devices associated with this application
+	tombstones, err := getTombstones(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	// Convert provisioned and decommissioned devices to a hash map
 	hashmap := make(map[string]struct{})
 	var s struct{}
 	for _, value := range provisionedDevices {
 		hashmap[value.LocalUUID] = s
 	}
+	for _, value := range tombstones {
+		hashmap[value.LocalUUID] = s
+	}
 
 	// Provision all unprovisioned devices associated with this application
 	for key := range onlineDevices {
+		// Only provision devices when processing every device
+		if ctx.Err() != nil || targets != nil {
+			break
+		}
+
 		if _, ok := hashmap[key]; ok {
-			// Device already provisioned
+			// Device already provisioned or decommissioned
 			continue
 		}
 
 		// Device not already provisioned
 		if errs := provisionDevice(a, key); errs != nil {
-			return errs
+			report.failProvision(key, errs...)
 		}
 	}
 
 	// Refesh all provisioned devices associated with this application
 	provisionedDevices, err = getProvisionedDevices(a)
 	if err != nil {
-		return []error{err}
+		return report.fail(err)
+	}
+
+	// Log devices which are backing off after previous failures
+	for _, value := range provisionedDevices {
+		if targets == nil && backingOff(value) {
+			log.WithFields(log.Fields{
+				"Name":     value.Name,
+				"Failures": value.Failures,
+				"Until":    value.BackoffUntil,
+			}).Info("Backing off device")
+		}
 	}
 
 	// Sync all provisioned devices associated with this application
 	for _, value := range provisionedDevices {
+		if skip(value) {
+			continue
+		}
+
 		if errs := value.Sync(); errs != nil {
-			return errs
+			report.failDevice(value, errs...)
+			continue
 		}
 
 		if err := updateDevice(value); err != nil {
-			return []error{err}
+			report.failDevice(value, err)
+			continue
+		}
+
+		// updateDevice keeps the stored targets so the targets synced from the supervisor are saved explicitly
+		if err := updateDeviceField(value, "TargetConfig", value.TargetConfig); err != nil {
+			report.failDevice(value, err)
+			continue
+		}
+		if err := updateDeviceField(value, "TargetEnvironment", value.TargetEnvironment); err != nil {
+			report.failDevice(value, err)
 		}
 	}
 
 	// Refesh all provisioned devices associated with this application
 	provisionedDevices, err = getProvisionedDevices(a)
 	if err != nil {
-		return []error{err}
+		return report.fail(err)
+	}
+
+	// Get all update jobs associated with this application
+	jobs, err := getJobs(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	// unfinished returns true if the device's update to its target commit was interrupted and is to be resumed,
+	// including an update interrupted by the edge-node-manager stopping
+	// A failed update is retried like any other outdated device once its backoff has passed
+	unfinished := func(d device.Device) bool {
+		job, ok := jobs[d.ResinUUID]
+		return ok && job.TargetCommit == d.TargetCommit && job.Active() && job.Phase != update.FAILED
+	}
+
+	// rolledBack returns true if the device's update to its target commit was rolled back
+	rolledBack := func(d device.Device) bool {
+		job, ok := jobs[d.ResinUUID]
+		return ok && job.Phase == update.ROLLED_BACK && job.TargetCommit == d.TargetCommit
+	}
+
+	// held returns true if the device's failed update to its target commit is backing off or quarantined
+	held := func(d device.Device) bool {
+		job, ok := jobs[d.ResinUUID]
+		return ok && job.TargetCommit == d.TargetCommit && job.Held(time.Now())
 	}
 
 	// Set state for all provisioned devices associated with this application
 	for _, value := range provisionedDevices {
+		if skip(value) {
+			continue
+		}
+
 		if _, ok := onlineDevices[value.LocalUUID]; ok {
 			value.Status = deviceStatus.IDLE
+
+			if value.Commit != value.TargetCommit && rolledBack(value) {
+				// Do not update the device again until its target commit changes
+				value.Status = deviceStatus.ROLLED_BACK
+			} else if value.Commit != value.TargetCommit && held(value) {
+				// Do not update the device again until its backoff has passed or the update is retried through the API
+				value.Status = deviceStatus.UPDATE_FAILED
+			} else if value.Commit != value.TargetCommit && downloading(value.ApplicationUUID, value.TargetCommit) {
+				// The device is updated once the firmware has been prefetched
+				value.Status = deviceStatus.DOWNLOADING
+			} else if value.Commit != value.TargetCommit && !unfinished(value) {
+				// Defer outdated devices until their maintenance window opens
+				closed, err := outsideMaintenanceWindow(a, value, time.Now())
+				if err != nil {
+					// Only the update is deferred, the rest of the device is processed as normal
+					log.WithFields(log.Fields{
+						"Name":  value.Name,
+						"Error": err,
+					}).Warn("Unable to parse maintenance windows")
+					hook.Create(value.ResinUUID).WithFields(log.Fields{
+						"Error": err,
+					}).Error("Unable to parse maintenance windows, the update is deferred")
+				}
+				if closed {
+					value.Status = deviceStatus.PENDING_UPDATE
+				}
+			}
+		} else if unfinished(value) && inBootloader(value) {
+			// The device was left in the bootloader by an unfinished update which will be resumed
+			value.Status = deviceStatus.INSTALLING
 		} else {
 			value.Status = deviceStatus.OFFLINE
 		}
 
 		if err := updateDevice(value); err != nil {
-			return []error{err}
+			report.failDevice(value, err)
+			continue
 		}
 
 		if errs := sendState(value); errs != nil {
-			return errs
+			report.failDevice(value, errs...)
 		}
 	}
 
 	// Refesh all provisioned devices associated with this application
 	provisionedDevices, err = getProvisionedDevices(a)
 	if err != nil {
-		return []error{err}
+		return report.fail(err)
+	}
+
+	// Restart all online, flagged, provisioned devices associated with this application
+	for _, value := range provisionedDevices {
+		if skip(value) || !value.RestartFlag || (value.Status == deviceStatus.OFFLINE) {
+			continue
+		}
+
+		// Populate board (and micro) for the device
+		if err := value.PopulateBoard(); err != nil {
+			report.failDevice(value, err)
+			continue
+		}
+
+		// Perform the restart
+		if errs := restartDevice(value); errs != nil {
+			report.failDevice(value, errs...)
+		}
+	}
+
+	// Refesh all provisioned devices associated with this application
+	provisionedDevices, err = getProvisionedDevices(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	// Identify all online, flagged, provisioned devices associated with this application
+	for _, value := range provisionedDevices {
+		if skip(value) || !value.IdentifyFlag || (value.Status == deviceStatus.OFFLINE) {
+			continue
+		}
+
+		// Populate board (and micro) for the device
+		if err := value.PopulateBoard(); err != nil {
+			report.failDevice(value, err)
+			continue
+		}
+
+		// Perform the identify, a failed identify does not stop the device being updated
+		if err := identifyDevice(value); err != nil {
+			report.warnDevice(value, err)
+		}
+	}
+
+	// Refesh all provisioned devices associated with this application
+	provisionedDevices, err = getProvisionedDevices(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	// Reconcile config and environment for all online, provisioned devices associated with this application
+	for _, value := range provisionedDevices {
+		if skip(value) || (value.Status == deviceStatus.OFFLINE) {
+			continue
+		}
+
+		if len(diff(deviceConfig(value.Config), deviceConfig(value.TargetConfig))) == 0 && len(diff(value.Environment, value.TargetEnvironment)) == 0 {
+			continue
+		}
+
+		// Populate board (and micro) for the device
+		if err := value.PopulateBoard(); err != nil {
+			report.failDevice(value, err)
+			continue
+		}
+
+		// Push the changes to the device, a failed reconcile does not stop the device being updated
+		if errs := reconcileDevice(value); errs != nil {
+			report.warnDevice(value, errs...)
+		}
+	}
+
+	// Refesh all provisioned devices associated with this application
+	provisionedDevices, err = getProvisionedDevices(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	// Confirm the firmware running on all online, up to date, provisioned devices associated with this application
+	for _, value := range provisionedDevices {
+		if skip(value) || value.Status != deviceStatus.IDLE || value.TargetCommit == "" || value.Commit != value.TargetCommit || unfinished(value) {
+			continue
+		}
+
+		if time.Now().Before(value.VersionChecked.Add(versionCheckDelay)) {
+			continue
+		}
+
+		// Populate board (and micro) for the device
+		if err := value.PopulateBoard(); err != nil {
+			report.failDevice(value, err)
+			continue
+		}
+
+		// A failed version check does not stop the device being updated
+		if errs := checkVersion(value); errs != nil {
+			report.warnDevice(value, errs...)
+		}
+	}
+
+	// Refesh all provisioned devices associated with this application
+	provisionedDevices, err = getProvisionedDevices(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	// Get the rollout of the application's target commit
+	rollout, err := getRollout(a, len(provisionedDevices))
+	if err != nil {
+		return report.fail(err)
+	}
+	if err := saveRollout(rollout); err != nil {
+		return report.fail(err)
 	}
 
-	// Update all online, outdated, provisioned devices associated with this application
+	// Update all online, outdated or part updated, provisioned devices associated with this application
 	for _, value := range provisionedDevices {
-		if (value.Commit != value.TargetCommit) && (value.Status != deviceStatus.OFFLINE) {
-			// Populate board (and micro) for the device
-			if err := value.PopulateBoard(); err != nil {
-				return []error{err}
+		if skip(value) || (value.Commit == value.TargetCommit && !unfinished(value)) || (value.Status != deviceStatus.IDLE && value.Status != deviceStatus.INSTALLING) {
+			continue
+		}
+
+		// Only devices targeting the application's commit are staged, devices pinned to another commit are not
+		staged := value.TargetCommit == rollout.TargetCommit
+		if staged && !rollout.Admit(value.ResinUUID) {
+			log.WithFields(log.Fields{
+				"Name":    value.Name,
+				"Stage":   rollout.Stage,
+				"Halted":  rollout.Halted,
+				"Allowed": rollout.Allowed(),
+			}).Info("Update deferred by rollout")
+			continue
+		}
+
+		// Populate board (and micro) for the device
+		if err := value.PopulateBoard(); err != nil {
+			report.failDevice(value, err)
+			if staged {
+				rollout.Withdraw(value.ResinUUID)
 			}
+			continue
+		}
+
+		// Perform the update
+		if errs := updateFirmware(ctx, value); errs != nil {
+			report.failDevice(value, errs...)
+		}
 
-			// Perform the update
-			if errs := updateFirmware(value); errs != nil {
-				return errs
+		if staged {
+			if err := recordRollout(rollout, value); err != nil {
+				report.failDevice(value, err)
 			}
 		}
 	}
 
-	return nil
+	// Refesh all provisioned devices associated with this application
+	provisionedDevices, err = getProvisionedDevices(a)
+	if err != nil {
+		return report.fail(err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report.fail(err)
+	}
+
+	// Update the failure counters and backoff for all processed devices
+	for _, value := range provisionedDevices {
+		if !processed(value) {
+			continue
+		}
+
+		if err := recordFailures(value, report); err != nil {
+			report.fail(err)
+		}
+	}
+
+	return report
 }
 
 func init() {
@@ -188,6 +476,54 @@ func init() {
 		}).Fatal("Unable to update retries")
 	}
 
+	if updateProbation, err = config.GetUpdateProbation(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load update probation")
+	}
+
+	if updateBackoff, err = config.GetUpdateBackoffDelay(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load update backoff delay")
+	}
+
+	if maxUpdateBackoff, err = config.GetUpdateBackoffMaxDelay(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load update backoff max delay")
+	}
+
+	if updateQuarantine, err = config.GetUpdateQuarantine(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load update quarantine")
+	}
+
+	if versionCheckDelay, err = config.GetVersionCheckDelay(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load version check delay")
+	}
+
+	if backoffDelay, err = config.GetBackoffDelay(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load backoff delay")
+	}
+
+	if maxBackoffDelay, err = config.GetMaxBackoffDelay(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load max backoff delay")
+	}
+
+	if wipe, err = config.GetDecommissionWipe(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to load decommission wipe")
+	}
+
 	lockLocation = config.GetLockFileLocation()
 
 	CurrentStatus = processStatus.RUNNING
@@ -196,18 +532,27 @@ func init() {
 	log.Debug("Initialised process")
 }
 
-func pause() error {
+func pause(ctx context.Context) error {
 	if TargetStatus != processStatus.PAUSED {
 		return nil
 	}
 
+	// Free the radios for use by user code whilst paused
+	if err := radio.Stop(); err != nil {
+		return err
+	}
+
 	CurrentStatus = processStatus.PAUSED
 	log.WithFields(log.Fields{
 		"Status": CurrentStatus,
 	}).Info("Process status")
 
 	for TargetStatus == processStatus.PAUSED {
-		time.Sleep(pauseDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pauseDelay):
+		}
 	}
 
 	CurrentStatus = processStatus.RUNNING
@@ -246,6 +591,21 @@ func getProvisionedDevices(a application.Application) ([]device.Device, error) {
 	return provisionedDevices, nil
 }
 
+func getTombstones(a application.Application) ([]device.Tombstone, error) {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var tombstones []device.Tombstone
+	if err := db.Find("ApplicationUUID", a.ResinUUID, &tombstones); err != nil && err.Error() != index.ErrNotFound.Error() {
+		return nil, err
+	}
+
+	return tombstones, nil
+}
+
 func provisionDevice(a application.Application, localUUID string) []error {
 	log.WithFields(log.Fields{
 		"Local UUID": localUUID,
@@ -282,32 +642,103 @@ func updateDevice(d device.Device) error {
 	}
 	defer db.Close()
 
+	// Keep the fields set by the supervisor hooks as they may have changed whilst the device was being processed
+	var stored device.Device
+	if err := db.One("ResinUUID", d.ResinUUID, &stored); err != nil {
+		return err
+	}
+	d.TargetCommit = stored.TargetCommit
+	d.RestartFlag = stored.RestartFlag
+	d.DeleteFlag = stored.DeleteFlag
+	d.IdentifyFlag = stored.IdentifyFlag
+	d.IdentifyDuration = stored.IdentifyDuration
+	d.TargetConfig = stored.TargetConfig
+	d.TargetEnvironment = stored.TargetEnvironment
+
 	return db.Update(&d)
 }
 
+func updateDeviceField(d device.Device, field string, value interface{}) error {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.UpdateField(&d, field, value)
+}
+
+func backingOff(d device.Device) bool {
+	return time.Now().Before(d.BackoffUntil)
+}
+
+// recordFailures increments the device's failure counter and backs it off exponentially if it failed this loop,
+// otherwise the failure counter is reset
+func recordFailures(d device.Device, r *Report) error {
+	if !r.failed(d) {
+		if d.Failures == 0 {
+			return nil
+		}
+
+		// Use UpdateField as storm ignores zero values when updating the whole record
+		return updateDeviceField(d, "Failures", 0)
+	}
+
+	d.Failures++
+
+	delay := backoff(d.Failures, backoffDelay, maxBackoffDelay)
+	d.BackoffUntil = time.Now().Add(delay)
+
+	log.WithFields(log.Fields{
+		"Name":     d.Name,
+		"Failures": d.Failures,
+		"Delay":    delay,
+	}).Warn("Device failed, backing off")
+
+	return updateDevice(d)
+}
+
+// backoff returns the delay after the given number of consecutive failures, doubling from delay up to max
+func backoff(failures int, delay, max time.Duration) time.Duration {
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
 func sendState(d device.Device) []error {
 	online := true
 	if d.Status == deviceStatus.OFFLINE {
 		online = false
 	}
 
-	return supervisor.DependentDeviceInfoUpdateWithOnlineState(d.ResinUUID, (string)(d.Status), d.Commit, online)
-}
-
-func updateFirmware(d device.Device) []error {
-	online, err := d.Board.Online()
-	if err != nil {
-		return []error{err}
-	} else if !online {
-		return nil
+	state := (string)(d.Status)
+	if d.Status == deviceStatus.DOWNLOADING {
+		// Report how much of the firmware has been downloaded alongside the status
+		if download, ok := bundle.GetDownload(d.ApplicationUUID, d.TargetCommit); ok && download.Size > 0 {
+			state = fmt.Sprintf("%s (%d%%)", state, download.Received*100/download.Size)
+		}
+	} else if d.Status == deviceStatus.UPDATE_FAILED {
+		// Report why the update failed alongside the status
+		job, err := getJob(d)
+		if err != nil {
+			return []error{err}
+		}
+		if job != nil && job.Failure != "" {
+			state = fmt.Sprintf("%s (%s): %s", state, job.Failure, job.LastError)
+		} else if job != nil && job.LastError != "" {
+			state += ": " + job.LastError
+		}
 	}
 
-	filepath, err := getFirmware(d)
-	if err != nil {
-		return []error{err}
-	}
+	return supervisor.DependentDeviceInfoUpdateWithOnlineState(d.ResinUUID, state, d.Commit, online)
+}
 
-	d.Status = deviceStatus.INSTALLING
+func restartDevice(d device.Device) []error {
+	d.Status = deviceStatus.STOPPING
 	if err := updateDevice(d); err != nil {
 		return []error{err}
 	}
@@ -315,67 +746,718 @@ func updateFirmware(d device.Device) []error {
 		return errs
 	}
 
-	for i := 1; i <= updateRetries; i++ {
+	log.WithFields(log.Fields{
+		"Name": d.Name,
+	}).Info("Starting restart")
+
+	if err := d.Board.Restart(); err != nil {
 		log.WithFields(log.Fields{
-			"Name":    d.Name,
-			"Attempt": i,
-		}).Info("Starting update")
+			"Name":  d.Name,
+			"Error": err,
+		}).Error("Restart failed")
 
-		if err := d.Board.Update(filepath); err != nil {
-			log.WithFields(log.Fields{
+		// Leave the restart flag set so the restart is attempted again once the device is processed next
+		d.Status = deviceStatus.IDLE
+		if err := updateDevice(d); err != nil {
+			return []error{err}
+		}
+		return append(sendState(d), err)
+	}
+
+	// Use UpdateField as storm ignores zero values when updating the whole record
+	d.RestartFlag = false
+	if err := updateDeviceField(d, "RestartFlag", false); err != nil {
+		return []error{err}
+	}
+
+	d.Status = deviceStatus.STARTING
+	if err := updateDevice(d); err != nil {
+		return []error{err}
+	}
+	if errs := sendState(d); errs != nil {
+		return errs
+	}
+
+	// Confirm the device has come back online
+	online, err := d.Board.Online()
+	if err != nil {
+		return []error{err}
+	}
+
+	if online {
+		log.WithFields(log.Fields{
+			"Name": d.Name,
+		}).Info("Finished restart")
+		d.Status = deviceStatus.IDLE
+	} else {
+		log.WithFields(log.Fields{
+			"Name": d.Name,
+		}).Warn("Device did not come back online after restart")
+		d.Status = deviceStatus.OFFLINE
+	}
+
+	if err := updateDevice(d); err != nil {
+		return []error{err}
+	}
+	return sendState(d)
+}
+
+func identifyDevice(d device.Device) error {
+	log.WithFields(log.Fields{
+		"Name":     d.Name,
+		"Duration": d.IdentifyDuration,
+	}).Info("Starting identify")
+
+	identifyErr := d.Board.Identify(d.IdentifyDuration)
+	if identifyErr != nil {
+		log.WithFields(log.Fields{
+			"Name":  d.Name,
+			"Error": identifyErr,
+		}).Error("Identify failed")
+
+		// Report the failure to the dependent device logs
+		hook.Create(d.ResinUUID).WithFields(log.Fields{
+			"Error": identifyErr,
+		}).Error("Identify failed")
+	} else {
+		log.WithFields(log.Fields{
+			"Name": d.Name,
+		}).Info("Finished identify")
+	}
+
+	// Clear the flag regardless of the result as it has been reported to the dependent device logs
+	if err := updateDeviceField(d, "IdentifyFlag", false); err != nil {
+		return err
+	}
+
+	return identifyErr
+}
+
+// reconcileDevice pushes any config and environment changes to the device
+// The applied values are only persisted once the device has acknowledged them
+func reconcileDevice(d device.Device) []error {
+	var errs []error
+
+	if changes := diff(deviceConfig(d.Config), deviceConfig(d.TargetConfig)); len(changes) > 0 {
+		log.WithFields(log.Fields{
+			"Name":    d.Name,
+			"Changes": changes,
+		}).Info("Updating config")
+
+		if err := d.Board.UpdateConfig(changes); err != nil {
+			log.WithFields(log.Fields{
+				"Name":  d.Name,
+				"Error": err,
+			}).Error("Update config failed")
+			errs = append(errs, err)
+		} else {
+			d.Config = applied(deviceConfig(d.TargetConfig))
+		}
+	}
+
+	if changes := diff(d.Environment, d.TargetEnvironment); len(changes) > 0 {
+		log.WithFields(log.Fields{
+			"Name":    d.Name,
+			"Changes": changes,
+		}).Info("Updating environment")
+
+		if err := d.Board.UpdateEnvironment(changes); err != nil {
+			log.WithFields(log.Fields{
+				"Name":  d.Name,
+				"Error": err,
+			}).Error("Update environment failed")
+			errs = append(errs, err)
+		} else {
+			d.Environment = applied(d.TargetEnvironment)
+		}
+	}
+
+	if err := updateDevice(d); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// deviceConfig returns the config variables to push to the device, leaving out the variables used by the
+// edge-node-manager and the supervisor such as the maintenance windows (ENM_MAINTENANCE_WINDOW)
+func deviceConfig(config map[string]interface{}) map[string]interface{} {
+	if config == nil {
+		return nil
+	}
+
+	filtered := make(map[string]interface{})
+	for key, value := range config {
+		if strings.HasPrefix(key, "ENM_") || strings.HasPrefix(key, "RESIN_") {
+			continue
+		}
+		filtered[key] = value
+	}
+
+	return filtered
+}
+
+// applied returns the variables to record as applied, never nil as storm ignores zero values on update
+func applied(target map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		return make(map[string]interface{})
+	}
+	return target
+}
+
+// diff returns the variables in target that are new or differ from current
+// Variables removed from target are returned with a nil value
+func diff(current, target map[string]interface{}) map[string]interface{} {
+	changes := make(map[string]interface{})
+
+	for key, value := range target {
+		if existing, ok := current[key]; !ok || !reflect.DeepEqual(existing, value) {
+			changes[key] = value
+		}
+	}
+
+	for key := range current {
+		if _, ok := target[key]; !ok {
+			changes[key] = nil
+		}
+	}
+
+	return changes
+}
+
+// updateFirmware flashes the device with the target commit, recording the progress in an update job
+// An unfinished job for the target commit is resumed, the device reports how much of the firmware it already has
+func updateFirmware(ctx context.Context, d device.Device) []error {
+	online, err := d.Board.Online()
+	if err != nil {
+		return []error{err}
+	} else if !online {
+		return nil
+	}
+
+	job, err := getJob(d)
+	if err != nil {
+		return []error{err}
+	}
+
+	if job == nil || !job.Active() || job.TargetCommit != d.TargetCommit {
+		created := update.New(d.ApplicationUUID, d.ResinUUID, d.TargetCommit)
+		job = &created
+	} else {
+		log.WithFields(log.Fields{
+			"Name":               d.Name,
+			"Bytes acknowledged": job.BytesAcknowledged,
+			"Attempt":            job.Attempt,
+			"Failures":           job.Failures,
+			"Last error":         job.LastError,
+		}).Info("Resuming update")
+	}
+
+	job.Phase = update.DOWNLOADING
+	if err := saveJob(job); err != nil {
+		return []error{err}
+	}
+
+	if !bundle.Cached(d.ApplicationUUID, d.TargetCommit) {
+		d.Status = deviceStatus.DOWNLOADING
+		if err := updateDevice(d); err != nil {
+			return []error{err}
+		}
+		if errs := sendState(d); errs != nil {
+			return errs
+		}
+	}
+
+	defer forgetProgress(d)
+	trackProgress(d, DOWNLOAD, 0, 0)
+
+	filepath, err := getFirmware(ctx, d.ApplicationUUID, d.TargetCommit)
+	if err != nil {
+		if rejected, ok := err.(bundle.RejectedError); ok {
+			// Report the rejection to the dependent device logs
+			hook.Create(d.ResinUUID).WithFields(log.Fields{
+				"Commit": d.TargetCommit,
+				"Reason": rejected.Reason,
+			}).Error("Firmware rejected")
+		}
+		return failJob(d, job, err)
+	}
+
+	d.Status = deviceStatus.INSTALLING
+	if err := updateDevice(d); err != nil {
+		return []error{err}
+	}
+	if errs := sendState(d); errs != nil {
+		return errs
+	}
+
+	// Persist the bytes acknowledged by the device as the update progresses
+	// The steps before the transfer do not know the size of the firmware yet so only the live progress is updated
+	progress := func(step board.Step, acknowledged, size int) {
+		trackProgress(d, string(step), acknowledged, size)
+		if size == 0 {
+			return
+		}
+
+		job.BytesAcknowledged = acknowledged
+		job.Size = size
+		if err := saveJob(job); err != nil {
+			log.WithFields(log.Fields{
 				"Name":  d.Name,
 				"Error": err,
+			}).Warn("Unable to save update progress")
+		}
+	}
+
+	var updateErr error
+	for i := 1; i <= updateRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			updateErr = failure.Cancelled(err)
+			break
+		}
+
+		job.Attempt++
+		job.Phase = update.TRANSFERRING
+		if err := saveJob(job); err != nil {
+			return []error{err}
+		}
+
+		log.WithFields(log.Fields{
+			"Name":    d.Name,
+			"Attempt": job.Attempt,
+		}).Info("Starting update")
+
+		if updateErr = d.Board.Update(filepath, progress); updateErr != nil {
+			log.WithFields(log.Fields{
+				"Name":     d.Name,
+				"Error":    updateErr,
+				"Category": failure.Classify(updateErr),
 			}).Error("Update failed")
+
+			job.LastError = updateErr.Error()
+
+			// Only retry straight away if the failure may not happen again
+			if !failure.Retryable(updateErr) {
+				break
+			}
 			continue
 		} else {
 			log.WithFields(log.Fields{
 				"Name": d.Name,
 			}).Info("Finished update")
-			d.Commit = d.TargetCommit
 			break
 		}
 	}
 
+	if updateErr != nil {
+		return failJob(d, job, updateErr)
+	}
+
+	job.Phase = update.PROBATION
+	if err := saveJob(job); err != nil {
+		return []error{err}
+	}
+
+	// Only record the new commit once the device is seen running it, otherwise roll it back
 	d.Status = deviceStatus.IDLE
+	version, confirmErr := confirmUpdate(d)
+	if confirmErr == nil {
+		d.Commit = d.TargetCommit
+		d.Version = version
+		d.VersionChecked = time.Now()
+		job.Phase = update.COMPLETE
+		job.LastError = ""
+	} else if rollbackErr := rollbackFirmware(ctx, d); rollbackErr != nil {
+		return failJob(d, job, fmt.Errorf("%s, rollback failed: %s", confirmErr, rollbackErr))
+	} else {
+		job.Phase = update.ROLLED_BACK
+		job.LastError = confirmErr.Error()
+		d.Status = deviceStatus.ROLLED_BACK
+	}
+	if err := saveJob(job); err != nil {
+		return []error{err}
+	}
+
 	if err := updateDevice(d); err != nil {
 		return []error{err}
 	}
-	return sendState(d)
+
+	errs := sendState(d)
+	if confirmErr != nil {
+		errs = append(errs, confirmErr)
+	}
+	return errs
 }
 
-func getFirmware(d device.Device) (string, error) {
-	// Build the file paths
-	filepath := config.GetAssetsDir()
-	filepath = path.Join(filepath, strconv.Itoa(d.ApplicationUUID))
-	filepath = path.Join(filepath, d.TargetCommit)
-	tarPath := path.Join(filepath, "binary.tar")
+// confirmUpdate waits up to the probation timeout for the device to be seen running its new firmware
+// If the device reports the commit it is running that must be the target commit, the reported version is returned
+func confirmUpdate(d device.Device) (string, error) {
+	log.WithFields(log.Fields{
+		"Name":      d.Name,
+		"Probation": updateProbation,
+	}).Info("Confirming update")
+
+	// The application must be advertising itself and report its version, a device still in its bootloader may be
+	// seen at the same address so being online is not enough
+	deadline := time.Now().Add(updateProbation)
+	var version string
+	for {
+		var err error
+		version, err = readApplicationVersion(d)
+		if err == nil {
+			break
+		}
 
-	// Check if the firmware exists
-	if _, err := os.Stat(tarPath); os.IsNotExist(err) {
-		// Download the firmware
-		if err := supervisor.DependentApplicationUpdate(d.ApplicationUUID, d.TargetCommit); err != nil {
-			return "", err
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("Update not confirmed within %s: %v", updateProbation, err)
 		}
 
-		// Extract the firmware
-		if err := tarinator.UnTarinate(filepath, tarPath); err != nil {
-			return "", err
+		// Avoid spinning if the radio fails straight away
+		time.Sleep(time.Second)
+	}
+
+	if reportsCommit(version) && !runningCommit(version, d.TargetCommit) {
+		return version, fmt.Errorf("Device is running %s rather than %s", version, d.TargetCommit)
+	}
+
+	log.WithFields(log.Fields{
+		"Name":    d.Name,
+		"Version": version,
+	}).Info("Confirmed update")
+
+	return version, nil
+}
+
+// readApplicationVersion returns the version reported by the device once its application is advertising
+func readApplicationVersion(d device.Device) (string, error) {
+	onlineDevices, err := d.Board.Scan(d.ApplicationUUID)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := onlineDevices[d.LocalUUID]; !ok {
+		return "", fmt.Errorf("Application not advertising")
+	}
+
+	return d.Board.Version()
+}
+
+// checkVersion reads the version of the firmware running on the device to detect firmware flashed out of band
+// A device found running another commit records that commit, so it is updated to its target commit again
+func checkVersion(d device.Device) []error {
+	version, err := d.Board.Version()
+	if err != nil {
+		// Not all firmware can report its version, the device is checked again after the version check delay
+		log.WithFields(log.Fields{
+			"Name":  d.Name,
+			"Error": err,
+		}).Debug("Unable to read firmware version")
+	}
+
+	d.Version = version
+	d.VersionChecked = time.Now()
+
+	drifted := err == nil && reportsCommit(version) && !runningCommit(version, d.Commit)
+	if drifted {
+		log.WithFields(log.Fields{
+			"Name":    d.Name,
+			"Commit":  d.Commit,
+			"Version": version,
+		}).Warn("Firmware drift detected")
+
+		// Report the drift to the dependent device logs
+		hook.Create(d.ResinUUID).WithFields(log.Fields{
+			"Commit":  d.Commit,
+			"Version": version,
+		}).Warn("Firmware drift detected")
+
+		// The device may report an abbreviated commit so it is resolved to a full commit known to the cache
+		// Firmware which can not be resolved is unknown, like a newly provisioned device's, and is updated again
+		commit, err := resolveCommit(d, version)
+		if err != nil {
+			return []error{err}
 		}
+		d.Commit = commit
+	}
+
+	if err := updateDevice(d); err != nil {
+		return []error{err}
+	}
+
+	if drifted {
+		return sendState(d)
 	}
 
-	return filepath, nil
+	return nil
+}
+
+// reportsCommit returns true if the version is a commit hash, which may be abbreviated
+// Firmware which does not report its commit may report another identifier such as its runtime version or build date,
+// so an abbreviated hash must contain a letter to tell it apart from a number
+func reportsCommit(version string) bool {
+	if len(version) < 7 || len(version) > 40 {
+		return false
+	}
+
+	letter := false
+	for _, c := range version {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+		letter = letter || c >= 'a'
+	}
+
+	return letter || len(version) == 40
+}
+
+// runningCommit returns true if the commit hash reported by the device identifies the commit
+func runningCommit(version, commit string) bool {
+	return commit != "" && strings.HasPrefix(commit, version)
+}
+
+// resolveCommit returns the full commit of the device's target commit or cached firmware which the version reported
+// by the device identifies, or an empty commit if it identifies none or more than one of them
+func resolveCommit(d device.Device, version string) (string, error) {
+	usage, err := bundle.GetUsage(nil)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := map[string]struct{}{
+		d.TargetCommit: {},
+	}
+	for _, value := range usage.Bundles {
+		if value.ApplicationUUID == d.ApplicationUUID {
+			candidates[value.Commit] = struct{}{}
+		}
+	}
+
+	var resolved []string
+	for commit := range candidates {
+		if runningCommit(version, commit) {
+			resolved = append(resolved, commit)
+		}
+	}
+
+	if len(resolved) != 1 {
+		return "", nil
+	}
+
+	return resolved[0], nil
 }
 
-func handleDelete(a application.Application) error {
+// rollbackFirmware flashes the device with the commit it was running before the update
+// The previous commit's firmware is kept in the assets directory as it is still referenced by the device
+func rollbackFirmware(ctx context.Context, d device.Device) error {
+	if d.Commit == "" {
+		return fmt.Errorf("No previous firmware")
+	}
+
+	log.WithFields(log.Fields{
+		"Name":   d.Name,
+		"Commit": d.Commit,
+	}).Warn("Rolling back update")
+
+	filepath, err := getFirmware(ctx, d.ApplicationUUID, d.Commit)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Board.Update(filepath, func(board.Step, int, int) {}); err != nil {
+		return err
+	}
+
+	hook.Create(d.ResinUUID).WithFields(log.Fields{
+		"Commit":        d.Commit,
+		"Target commit": d.TargetCommit,
+	}).Warn("Rolled back update")
+
+	return nil
+}
+
+// failJob records the error against the update job and backs off the update to the target commit exponentially
+// Once the quarantine threshold is reached the update is only attempted again when it is retried through the API
+// Firmware the device rejects or is incompatible with is quarantined straight away, a cancelled update is not backed off
+func failJob(d device.Device, job *update.Job, err error) []error {
+	job.Phase = update.FAILED
+	job.LastError = err.Error()
+	job.Failure = failure.Classify(err)
+
+	switch job.Failure {
+	case failure.CANCELLED:
+		job.RetryAfter = time.Time{}
+	case failure.REJECTED, failure.INCOMPATIBLE:
+		job.Failures++
+		job.Quarantined = true
+	default:
+		job.Failures++
+		job.RetryAfter = time.Now().Add(backoff(job.Failures, updateBackoff, maxUpdateBackoff))
+		if updateQuarantine > 0 && job.Failures >= updateQuarantine {
+			job.Quarantined = true
+		}
+	}
+
+	if saveErr := saveJob(job); saveErr != nil {
+		return []error{saveErr, err}
+	}
+
+	log.WithFields(log.Fields{
+		"Name":        d.Name,
+		"Failures":    job.Failures,
+		"Retry after": job.RetryAfter,
+		"Quarantined": job.Quarantined,
+		"Category":    job.Failure,
+		"Error":       err,
+	}).Error("Update failed")
+
+	// Report the failure to the dependent device logs
+	deviceLog := hook.Create(d.ResinUUID).WithFields(log.Fields{
+		"Commit":   job.TargetCommit,
+		"Failures": job.Failures,
+		"Category": job.Failure,
+		"Error":    err,
+	})
+	if job.Quarantined {
+		deviceLog.Error("Update quarantined, retry it through the API")
+	} else {
+		deviceLog.WithFields(log.Fields{
+			"Retry after": job.RetryAfter,
+		}).Error("Update failed")
+	}
+
+	d.Status = deviceStatus.UPDATE_FAILED
+	if updateErr := updateDevice(d); updateErr != nil {
+		return []error{updateErr, err}
+	}
+
+	return append(sendState(d), err)
+}
+
+func handleDelete(a application.Application, r *Report) error {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+
+	var deletedDevices []device.Device
+	err = db.Select(q.Eq("ApplicationUUID", a.ResinUUID), q.Eq("DeleteFlag", true)).Find(&deletedDevices)
+	db.Close()
+	if err != nil && err.Error() != index.ErrNotFound.Error() {
+		return err
+	}
+
+	if len(deletedDevices) == 0 {
+		return nil
+	}
+
+	for _, value := range deletedDevices {
+		if err := decommissionDevice(value); err != nil {
+			r.failDevice(value, err)
+		}
+	}
+
+	return nil
+}
+
+// decommissionDevice optionally wipes the device before removing it from the database
+// A tombstone is kept so the device is not provisioned again while it still advertises the application
+func decommissionDevice(d device.Device) error {
+	log.WithFields(log.Fields{
+		"Name": d.Name,
+	}).Info("Decommissioning device")
+
+	// Report the result to the dependent device logs
+	deviceLog := hook.Create(d.ResinUUID)
+
+	if wipe {
+		if err := wipeDevice(d); err != nil {
+			log.WithFields(log.Fields{
+				"Name":  d.Name,
+				"Error": err,
+			}).Error("Wipe failed")
+
+			deviceLog.WithFields(log.Fields{
+				"Error": err,
+			}).Error("Wipe failed")
+		}
+	}
+
+	if err := deleteJob(d); err != nil {
+		return err
+	}
+
 	db, err := storm.Open(config.GetDbPath())
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	if err := db.Select(q.Eq("ApplicationUUID", a.ResinUUID), q.Eq("DeleteFlag", true)).Delete(&device.Device{}); err != nil && err.Error() != index.ErrNotFound.Error() {
+	tombstone := device.Tombstone{
+		LocalUUID:       d.LocalUUID,
+		ApplicationUUID: d.ApplicationUUID,
+		ResinUUID:       d.ResinUUID,
+		Name:            d.Name,
+		Decommissioned:  time.Now(),
+	}
+	if err := db.Save(&tombstone); err != nil {
 		return err
 	}
 
+	if err := db.DeleteStruct(&d); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"Name": d.Name,
+	}).Info("Decommissioned device")
+
+	deviceLog.Info("Decommissioned")
+
 	return nil
 }
+
+// outsideMaintenanceWindow returns true if the device may not be updated at the given time
+// The device config takes precedence over the application config, devices may be updated at any time if neither sets windows
+func outsideMaintenanceWindow(a application.Application, d device.Device, now time.Time) (bool, error) {
+	spec, ok := d.TargetConfig[maintenance.Key]
+	if !ok {
+		spec, ok = a.Config[maintenance.Key]
+	}
+	if !ok || spec == nil || fmt.Sprint(spec) == "" {
+		return false, nil
+	}
+
+	windows, err := maintenance.Parse(fmt.Sprint(spec))
+	if err != nil {
+		// Do not update the device when its windows can not be parsed
+		return true, err
+	}
+
+	return !windows.Open(now), nil
+}
+
+// inBootloader returns true if the device is online but not advertising the application,
+// as happens when it is left in the bootloader by an interrupted update
+func inBootloader(d device.Device) bool {
+	if err := d.PopulateBoard(); err != nil {
+		return false
+	}
+
+	online, err := d.Board.Online()
+	return err == nil && online
+}
+
+func wipeDevice(d device.Device) error {
+	if err := d.PopulateBoard(); err != nil {
+		return err
+	}
+
+	online, err := d.Board.Online()
+	if err != nil {
+		return err
+	} else if !online {
+		return fmt.Errorf("Device offline")
+	}
+
+	return d.Board.Decommission()
+}
@@ -0,0 +1,158 @@
+package process
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/maintenance"
+)
+
+func TestOutsideMaintenanceWindow(t *testing.T) {
+	// 2018-04-09 is a Monday
+	monday := time.Date(2018, time.April, 9, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		application map[string]interface{}
+		device      map[string]interface{}
+		closed      bool
+		err         bool
+	}{
+		{"no windows", nil, nil, false, false},
+		{"empty windows", map[string]interface{}{maintenance.Key: ""}, nil, false, false},
+		{"null windows", map[string]interface{}{maintenance.Key: nil}, nil, false, false},
+		{"application window open", map[string]interface{}{maintenance.Key: "02:00-04:00"}, nil, false, false},
+		{"application window closed", map[string]interface{}{maintenance.Key: "Tue-Sun 02:00-04:00"}, nil, true, false},
+		{"window crossing midnight", map[string]interface{}{maintenance.Key: "Sun 22:00-06:00"}, nil, false, false},
+		{"device window open", nil, map[string]interface{}{maintenance.Key: "Mon 00:00-24:00"}, false, false},
+		{"device window closed", nil, map[string]interface{}{maintenance.Key: "Mon 12:00-13:00"}, true, false},
+		{
+			"device overrides application",
+			map[string]interface{}{maintenance.Key: "02:00-04:00"},
+			map[string]interface{}{maintenance.Key: "Sat,Sun 00:00-24:00"},
+			true, false,
+		},
+		{
+			"device clears application",
+			map[string]interface{}{maintenance.Key: "Sat,Sun 00:00-24:00"},
+			map[string]interface{}{maintenance.Key: ""},
+			false, false,
+		},
+		{"invalid windows", map[string]interface{}{maintenance.Key: "whenever"}, nil, true, true},
+	}
+
+	for _, test := range tests {
+		a := application.Application{Config: test.application}
+		d := device.Device{TargetConfig: test.device}
+
+		closed, err := outsideMaintenanceWindow(a, d, monday)
+		if (err != nil) != test.err {
+			t.Errorf("%s: outsideMaintenanceWindow() error %v, expected an error %t", test.name, err, test.err)
+		}
+		if closed != test.closed {
+			t.Errorf("%s: outsideMaintenanceWindow() = %t, expected %t", test.name, closed, test.closed)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		delay    time.Duration
+		max      time.Duration
+		expected time.Duration
+	}{
+		{0, 10 * time.Second, time.Minute, 10 * time.Second},
+		{1, 10 * time.Second, time.Minute, 10 * time.Second},
+		{2, 10 * time.Second, time.Minute, 20 * time.Second},
+		{3, 10 * time.Second, time.Minute, 40 * time.Second},
+		{4, 10 * time.Second, time.Minute, time.Minute},
+		{100, 10 * time.Second, time.Minute, time.Minute},
+		{1, 2 * time.Minute, time.Minute, time.Minute},
+	}
+
+	for _, test := range tests {
+		if delay := backoff(test.failures, test.delay, test.max); delay != test.expected {
+			t.Errorf("backoff(%d, %s, %s) = %s, expected %s", test.failures, test.delay, test.max, delay, test.expected)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  map[string]interface{}
+		target   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{"both empty", nil, nil, map[string]interface{}{}},
+		{"unchanged", map[string]interface{}{"A": "1"}, map[string]interface{}{"A": "1"}, map[string]interface{}{}},
+		{"added", nil, map[string]interface{}{"A": "1"}, map[string]interface{}{"A": "1"}},
+		{"changed", map[string]interface{}{"A": "1"}, map[string]interface{}{"A": "2"}, map[string]interface{}{"A": "2"}},
+		{"removed", map[string]interface{}{"A": "1", "B": "2"}, map[string]interface{}{"A": "1"}, map[string]interface{}{"B": nil}},
+		{"type changed", map[string]interface{}{"A": "1"}, map[string]interface{}{"A": 1.0}, map[string]interface{}{"A": 1.0}},
+		{
+			"nested",
+			map[string]interface{}{"A": map[string]interface{}{"B": "1"}},
+			map[string]interface{}{"A": map[string]interface{}{"B": "1"}},
+			map[string]interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		if changes := diff(test.current, test.target); !reflect.DeepEqual(changes, test.expected) {
+			t.Errorf("%s: diff(%v, %v) = %v, expected %v", test.name, test.current, test.target, changes, test.expected)
+		}
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+	tests := []struct {
+		config   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{nil, nil},
+		{map[string]interface{}{"A": "1"}, map[string]interface{}{"A": "1"}},
+		{
+			map[string]interface{}{"A": "1", maintenance.Key: "02:00-04:00", "ENM_ROLLOUT_CANARIES": "1", "RESIN_HOST_TYPE": "raspberrypi3"},
+			map[string]interface{}{"A": "1"},
+		},
+	}
+
+	for _, test := range tests {
+		if filtered := deviceConfig(test.config); !reflect.DeepEqual(filtered, test.expected) {
+			t.Errorf("deviceConfig(%v) = %v, expected %v", test.config, filtered, test.expected)
+		}
+	}
+}
+
+func TestReportsCommit(t *testing.T) {
+	tests := []struct {
+		version string
+		commit  bool
+	}{
+		{"", false},
+		{"1.2.3", false},
+		{"v1.0.0", false},
+		{"1234567", false},
+		{"20180411", false},
+		{"abcdef", false},
+		{"abcdef1", true},
+		{"1234a67", true},
+		{"ABCDEF1", false},
+		{"5f2b1e3c9a7d", true},
+		{"5f2b1e3c9a7d4e6f8a0b2c4d6e8f0a1b3c5d7e9f", true},
+		{"1234567890123456789012345678901234567890", true},
+		{"5f2b1e3c9a7d4e6f8a0b2c4d6e8f0a1b3c5d7e9f0", false},
+		{"abcdefg", false},
+	}
+
+	for _, test := range tests {
+		if commit := reportsCommit(test.version); commit != test.commit {
+			t.Errorf("reportsCommit(%q) = %t, expected %t", test.version, commit, test.commit)
+		}
+	}
+}
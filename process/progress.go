@@ -0,0 +1,140 @@
+package process
+
+import (
+	"sync"
+	"time"
+
+	"github.com/resin-io/edge-node-manager/bundle"
+	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/device/update"
+)
+
+// DOWNLOAD is the phase of an update in which the firmware is downloaded, the other phases are reported by the board
+const DOWNLOAD = "Download"
+
+// UpdateProgress describes the progress of a device's firmware update
+// The rate and ETA are only known whilst the firmware is being downloaded or transferred to the device
+type UpdateProgress struct {
+	ResinUUID      string
+	TargetCommit   string
+	Phase          string
+	Percent        float64
+	BytesPerSecond float64
+	Attempt        int
+	ETA            time.Time
+	LastError      string
+}
+
+// progress records the live progress of an update in flight
+type progress struct {
+	phase        string
+	acknowledged int
+	size         int
+	started      time.Time
+	startedAt    int
+}
+
+var (
+	progressMutex sync.Mutex
+	progresses    = make(map[string]*progress)
+)
+
+// GetUpdateProgress returns the progress of the device's update to its target commit
+// Updates in flight are reported live, otherwise the progress is taken from the device's update job
+func GetUpdateProgress(d device.Device) (UpdateProgress, error) {
+	result := UpdateProgress{
+		ResinUUID:    d.ResinUUID,
+		TargetCommit: d.TargetCommit,
+	}
+
+	job, err := getJob(d)
+	if err != nil {
+		return result, err
+	}
+	if job != nil && job.TargetCommit == d.TargetCommit {
+		result.Phase = string(job.Phase)
+		result.Attempt = job.Attempt
+		result.LastError = job.LastError
+		if job.Size > 0 {
+			result.Percent = percent(job.BytesAcknowledged, job.Size)
+		}
+		if job.Phase == update.COMPLETE {
+			result.Percent = 100
+		}
+	}
+
+	// Firmware may be downloading before the update starts if it is being prefetched
+	if download, ok := bundle.GetDownload(d.ApplicationUUID, d.TargetCommit); ok {
+		result.Phase = DOWNLOAD
+		result.Percent = 0
+		result.BytesPerSecond = download.BytesPerSecond
+		if download.Size > 0 {
+			result.Percent = percent(int(download.Received), int(download.Size))
+			result.ETA = eta(int(download.Received), int(download.Size), download.BytesPerSecond)
+		}
+		return result, nil
+	}
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	p, ok := progresses[d.ResinUUID]
+	if !ok || p.phase == DOWNLOAD {
+		return result, nil
+	}
+
+	result.Phase = p.phase
+	if p.size > 0 {
+		result.Percent = percent(p.acknowledged, p.size)
+	}
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 && p.acknowledged > p.startedAt {
+		result.BytesPerSecond = float64(p.acknowledged-p.startedAt) / elapsed
+		result.ETA = eta(p.acknowledged, p.size, result.BytesPerSecond)
+	}
+
+	return result, nil
+}
+
+// trackProgress records the phase and the bytes acknowledged by the device, the rate is measured from the start
+// of each phase
+func trackProgress(d device.Device, phase string, acknowledged, size int) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	p, ok := progresses[d.ResinUUID]
+	if !ok || p.phase != phase {
+		p = &progress{
+			phase:     phase,
+			started:   time.Now(),
+			startedAt: acknowledged,
+		}
+		progresses[d.ResinUUID] = p
+	}
+
+	p.acknowledged = acknowledged
+	if size > 0 {
+		p.size = size
+	}
+}
+
+// forgetProgress removes the live progress once the update has finished
+func forgetProgress(d device.Device) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	delete(progresses, d.ResinUUID)
+}
+
+func percent(done, total int) float64 {
+	return float64(done) * 100 / float64(total)
+}
+
+// eta returns when the remaining bytes are expected to be done at the rate, or the zero time if it is not known
+func eta(done, total int, bytesPerSecond float64) time.Time {
+	if bytesPerSecond <= 0 || total <= done {
+		return time.Time{}
+	}
+
+	remaining := float64(total-done) / bytesPerSecond
+	return time.Now().Add(time.Duration(remaining * float64(time.Second)))
+}
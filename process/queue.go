@@ -0,0 +1,55 @@
+package process
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Request asks for a device to be processed as soon as possible rather than waiting for the next loop
+type Request struct {
+	ApplicationUUID int
+	ResinUUID       string
+	Reason          string
+}
+
+var (
+	queueMutex sync.Mutex
+	queue      []Request
+	wake       = make(chan struct{}, 1)
+)
+
+// Enqueue adds a request to the queue and wakes the processor, it never blocks
+func Enqueue(request Request) {
+	queueMutex.Lock()
+	queue = append(queue, request)
+	queueMutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"Application UUID": request.ApplicationUUID,
+		"Resin UUID":       request.ResinUUID,
+		"Reason":           request.Reason,
+	}).Debug("Enqueued request")
+
+	select {
+	case wake <- struct{}{}:
+	default:
+		// The processor has already been woken
+	}
+}
+
+// Wake receives whenever requests have been enqueued
+func Wake() <-chan struct{} {
+	return wake
+}
+
+// Dequeue removes and returns all queued requests, there may be none if they were taken after an earlier wake
+func Dequeue() []Request {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	requests := queue
+	queue = nil
+
+	return requests
+}
@@ -0,0 +1,111 @@
+package process
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/device"
+)
+
+// Report records the errors encountered whilst processing an application
+// Application errors stop the application being processed, device errors only stop that device being processed
+// Device warnings are errors from steps which the rest of the device's processing does not depend on
+type Report struct {
+	Application string
+	Errors      []error
+	Devices     map[string]*DeviceReport
+}
+
+// DeviceReport records the errors encountered whilst processing a device
+type DeviceReport struct {
+	Name      string
+	LocalUUID string
+	ResinUUID string
+	Errors    []error
+	Warnings  []error
+}
+
+func newReport(a application.Application) *Report {
+	return &Report{
+		Application: a.Name,
+		Devices:     make(map[string]*DeviceReport),
+	}
+}
+
+// Failed returns true if any application or device errors or warnings were encountered
+func (r *Report) Failed() bool {
+	return len(r.Errors) > 0 || len(r.Devices) > 0
+}
+
+func (r *Report) String() string {
+	var devices []string
+	for _, value := range r.Devices {
+		devices = append(devices, value.String())
+	}
+
+	return fmt.Sprintf(
+		"Application: %s, "+
+			"Errors: %v, "+
+			"Devices: [%s]",
+		r.Application,
+		r.Errors,
+		strings.Join(devices, ", "))
+}
+
+func (d DeviceReport) String() string {
+	return fmt.Sprintf(
+		"{Name: %s, "+
+			"Local UUID: %s, "+
+			"Errors: %v, "+
+			"Warnings: %v}",
+		d.Name,
+		d.LocalUUID,
+		d.Errors,
+		d.Warnings)
+}
+
+// fail records application errors
+func (r *Report) fail(errs ...error) *Report {
+	r.Errors = append(r.Errors, errs...)
+	return r
+}
+
+// failDevice records errors for a provisioned device
+func (r *Report) failDevice(d device.Device, errs ...error) {
+	report := r.device(d.LocalUUID)
+	report.Name = d.Name
+	report.ResinUUID = d.ResinUUID
+	report.Errors = append(report.Errors, errs...)
+}
+
+// warnDevice records errors for a provisioned device which do not stop it being processed
+func (r *Report) warnDevice(d device.Device, errs ...error) {
+	report := r.device(d.LocalUUID)
+	report.Name = d.Name
+	report.ResinUUID = d.ResinUUID
+	report.Warnings = append(report.Warnings, errs...)
+}
+
+// failProvision records errors for a device which could not be provisioned
+func (r *Report) failProvision(localUUID string, errs ...error) {
+	report := r.device(localUUID)
+	report.Errors = append(report.Errors, errs...)
+}
+
+// failed returns true if errors have been recorded for the device
+func (r *Report) failed(d device.Device) bool {
+	report, ok := r.Devices[d.LocalUUID]
+	return ok && len(report.Errors) > 0
+}
+
+func (r *Report) device(localUUID string) *DeviceReport {
+	report, ok := r.Devices[localUUID]
+	if !ok {
+		report = &DeviceReport{
+			LocalUUID: localUUID,
+		}
+		r.Devices[localUUID] = report
+	}
+	return report
+}
@@ -0,0 +1,107 @@
+package process
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/index"
+	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/application/rollout"
+	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/device"
+	"github.com/resin-io/edge-node-manager/device/update"
+	"github.com/resin-io/edge-node-manager/failure"
+)
+
+// getRollout returns the rollout of the application's target commit, starting a new one if the target has changed
+// The policy is refreshed from the application config and the rollout is advanced if the current stage is done
+func getRollout(a application.Application, fleet int) (*rollout.Rollout, error) {
+	policy, err := rollout.GetPolicy(a.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var r rollout.Rollout
+	if err := db.One("ApplicationUUID", a.ResinUUID, &r); err != nil && err.Error() != index.ErrNotFound.Error() {
+		return nil, err
+	}
+
+	if r.TargetCommit != a.TargetCommit {
+		r = rollout.New(a.ResinUUID, a.TargetCommit, policy)
+
+		log.WithFields(log.Fields{
+			"Target commit": r.TargetCommit,
+			"Policy":        r.Policy,
+		}).Info("Starting rollout")
+	}
+
+	r.Policy = policy
+	r.Fleet = fleet
+
+	stage := r.Stage
+	r.Advance(time.Now())
+	if r.Stage != stage {
+		log.WithFields(log.Fields{
+			"Target commit": r.TargetCommit,
+			"Stage":         r.Stage,
+			"Allowed":       r.Allowed(),
+		}).Info("Advancing rollout")
+	}
+
+	return &r, nil
+}
+
+func saveRollout(r *rollout.Rollout) error {
+	db, err := storm.Open(config.GetDbPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r.Updated = time.Now()
+
+	return db.Save(r)
+}
+
+// recordRollout records the outcome of the device's update against the rollout
+// A device which was not updated, for example because it went offline, is withdrawn so it does not hold up the stage
+func recordRollout(r *rollout.Rollout, d device.Device) error {
+	job, err := getJob(d)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case job == nil || job.TargetCommit != d.TargetCommit:
+		r.Withdraw(d.ResinUUID)
+	case job.Phase == update.COMPLETE:
+		r.Record(d.ResinUUID, true)
+	case (job.Phase == update.FAILED || job.Phase == update.INTERRUPTED) && job.Failure == failure.CANCELLED:
+		// The update was stopped rather than failing so it does not count against the rollout
+		r.CountFailure(job.Failure)
+		r.Withdraw(d.ResinUUID)
+	case job.Phase == update.FAILED || job.Phase == update.ROLLED_BACK:
+		if job.Phase == update.FAILED {
+			r.CountFailure(job.Failure)
+		}
+		halted := r.Halted
+		r.Record(d.ResinUUID, false)
+		if r.Halted && !halted {
+			log.WithFields(log.Fields{
+				"Target commit": r.TargetCommit,
+				"Reason":        r.HaltReason,
+			}).Error("Rollout halted")
+		}
+	default:
+		r.Withdraw(d.ResinUUID)
+	}
+
+	return saveRollout(r)
+}
@@ -0,0 +1,117 @@
+package process
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fredli74/lockfile"
+	"github.com/resin-io/edge-node-manager/application"
+	"github.com/resin-io/edge-node-manager/radio"
+)
+
+// Schedule processes the applications and returns a report for each one
+// Applications using different radios are processed concurrently, applications sharing a radio are processed in order
+// If requests is nil every device is processed, otherwise only the devices targeted by the requests are processed
+// Cancelling the context stops any further applications being processed and returns once in flight applications stop
+func Schedule(ctx context.Context, applications map[int]application.Application, requests []Request) map[int]*Report {
+	reports := make(map[int]*Report)
+
+	// Start downloading new firmware straight away rather than once the first device is updated
+	for key, a := range applications {
+		Prefetch(key, a.TargetCommit)
+	}
+
+	// Stop downloading firmware which is no longer needed
+	if err := cancelStaleDownloads(applications); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to cancel stale firmware downloads")
+	}
+
+	// Convert the requests to the targeted applications and devices
+	var targets map[string]struct{}
+	if requests != nil {
+		targets = make(map[string]struct{})
+		targeted := make(map[int]application.Application)
+		for _, request := range requests {
+			targets[request.ResinUUID] = struct{}{}
+			if a, ok := applications[request.ApplicationUUID]; ok {
+				targeted[request.ApplicationUUID] = a
+			}
+		}
+		applications = targeted
+	}
+
+	// Sort applications to ensure they run in order
+	var keys []int
+	for key := range applications {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+
+	fail := func(err error) map[int]*Report {
+		for _, key := range keys {
+			reports[key] = newReport(applications[key]).fail(err)
+		}
+		return reports
+	}
+
+	// Pause the process if necessary
+	if err := pause(ctx); err != nil {
+		return fail(err)
+	}
+
+	// Enable update locking
+	lock, err := lockfile.Lock(lockLocation)
+	if err != nil {
+		return fail(err)
+	}
+	defer lock.Unlock()
+
+	// Group applications by radio
+	groups := make(map[radio.Type][]int)
+	for _, key := range keys {
+		r := applications[key].Board.Radio()
+		groups[r] = append(groups[r], key)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for r, keys := range groups {
+		log.WithFields(log.Fields{
+			"Radio":                  r,
+			"Number of applications": len(keys),
+		}).Debug("Scheduling applications")
+
+		wg.Add(1)
+		go func(keys []int) {
+			defer wg.Done()
+
+			for _, key := range keys {
+				if ctx.Err() != nil {
+					return
+				}
+
+				report := Run(ctx, applications[key], targets)
+
+				mutex.Lock()
+				reports[key] = report
+				mutex.Unlock()
+			}
+		}(keys)
+	}
+	wg.Wait()
+
+	// Remove unused firmware once every device has been processed
+	if requests == nil && ctx.Err() == nil {
+		if err := collectAssets(); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Error("Unable to remove unused firmware")
+		}
+	}
+
+	return reports
+}
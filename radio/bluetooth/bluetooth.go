@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,6 +18,8 @@ import (
 	"github.com/currantlabs/ble/linux/hci"
 	"github.com/currantlabs/ble/linux/hci/cmd"
 	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/failure"
+	"github.com/resin-io/edge-node-manager/radio"
 )
 
 var (
@@ -26,7 +30,25 @@ var (
 	longTimeout  time.Duration
 )
 
+var (
+	mtuMutex sync.Mutex
+	// mtus holds the MTU negotiated with each connected client
+	mtus = make(map[ble.Client]int)
+)
+
+const (
+	togglePeriod = 500 * time.Millisecond
+	// defaultMTU is the MTU used until a larger one is negotiated
+	defaultMTU = 23
+)
+
+// Initialise sets up the bluetooth device and starts the presence tracker
+// It returns immediately if the tracker is already running from a previous loop
 func Initialise() error {
+	if presences.isRunning() {
+		return nil
+	}
+
 	if !initialised && os.Getenv("RESIN_DEVICE_TYPE") == "raspberrypi3" {
 		log.Info("Initialising bluetooth")
 
@@ -57,33 +79,75 @@ func Initialise() error {
 	}
 
 	ble.SetDefaultDevice(device)
+	presences.start()
 
 	return nil
 }
 
+// Cleanup returns without stopping the device so the presence tracker keeps running between loops
+// The device is stopped by Stop when the radios need to be freed
 func Cleanup() error {
+	return nil
+}
+
+// Stop stops the presence tracker and the device
+func Stop() error {
+	if !presences.stop() {
+		return nil
+	}
+
+	log.Info("Stopping bluetooth")
+
 	return ble.Stop()
 }
 
+// Connect pauses the presence tracker for the duration of the connection
+// The device is forgotten by the tracker so it has to be seen again once disconnected to be online
 func Connect(id string) (ble.Client, error) {
+	presences.pause()
+	presences.forget(id)
+
 	client, err := ble.Dial(ble.WithSigHandler(context.WithTimeout(context.Background(), longTimeout)), hci.RandomAddress{ble.NewAddr(id)})
 	if err != nil {
-		return nil, err
-	}
-
-	if _, err := client.ExchangeMTU(ble.MaxMTU); err != nil {
-		return nil, err
+		presences.resume()
+		return nil, failure.Transient(err)
 	}
 
 	doneChannel = make(chan struct{})
 	go func() {
 		<-client.Disconnected()
+		mtuMutex.Lock()
+		delete(mtus, client)
+		mtuMutex.Unlock()
+		presences.resume()
 		close(doneChannel)
 	}()
 
+	mtu, err := client.ExchangeMTU(ble.MaxMTU)
+	if err != nil {
+		client.CancelConnection()
+		return nil, failure.Transient(err)
+	}
+
+	mtuMutex.Lock()
+	mtus[client] = mtu
+	mtuMutex.Unlock()
+
 	return client, nil
 }
 
+// GetMTU returns the MTU negotiated when the client connected
+func GetMTU(client ble.Client) int {
+	mtuMutex.Lock()
+	defer mtuMutex.Unlock()
+
+	if mtu, ok := mtus[client]; ok && mtu > defaultMTU {
+		return mtu
+	}
+
+	return defaultMTU
+}
+
 func Disconnect(client ble.Client) error {
 	if err := client.ClearSubscriptions(); err != nil {
 		return err
@@ -97,6 +161,35 @@ func Disconnect(client ble.Client) error {
 	return nil
 }
 
+// Close cancels the connection if the device has not already disconnected
+// It is deferred after each successful Connect so that returning early does not leave the connection open and
+// the presence tracker paused
+func Close(client ble.Client) {
+	select {
+	case <-client.Disconnected():
+		return
+	default:
+	}
+
+	client.CancelConnection()
+
+	select {
+	case <-client.Disconnected():
+	case <-time.After(longTimeout):
+	}
+}
+
+// AwaitDisconnect waits for the device to disconnect itself, returning an error if it is still connected after the
+// long timeout
+func AwaitDisconnect(client ble.Client) error {
+	select {
+	case <-client.Disconnected():
+		return nil
+	case <-time.After(longTimeout):
+		return failure.Transientf("Device did not disconnect")
+	}
+}
+
 func WriteCharacteristic(client ble.Client, characteristic *ble.Characteristic, value []byte, noRsp bool) error {
 	err := make(chan error)
 	go func() {
@@ -107,7 +200,7 @@ func WriteCharacteristic(client ble.Client, characteristic *ble.Characteristic,
 	case done := <-err:
 		return done
 	case <-time.After(shortTimeout):
-		return fmt.Errorf("Write characteristic timed out")
+		return failure.Transientf("Write characteristic timed out")
 	}
 }
 
@@ -129,7 +222,7 @@ func ReadCharacteristic(client ble.Client, characteristic *ble.Characteristic) (
 	case done := <-result:
 		return done.Val, done.Err
 	case <-time.After(shortTimeout):
-		return nil, fmt.Errorf("Read characteristic timed out")
+		return nil, failure.Transientf("Read characteristic timed out")
 	}
 }
 
@@ -143,63 +236,68 @@ func WriteDescriptor(client ble.Client, descriptor *ble.Descriptor, value []byte
 	case done := <-err:
 		return done
 	case <-time.After(shortTimeout):
-		return fmt.Errorf("Write descriptor timed out")
+		return failure.Transientf("Write descriptor timed out")
 	}
 }
 
-func Scan(id string) (map[string]struct{}, error) {
-	devices := make(map[string]struct{})
-	advChannel := make(chan ble.Advertisement)
-	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), longTimeout))
+// WriteVariables writes each variable to the characteristic as a KEY=VALUE entry
+// Variables with a nil value are written as KEY to remove them from the device
+// Each entry is written with response so the device acknowledges it before the next is sent
+func WriteVariables(client ble.Client, characteristic *ble.Characteristic, variables map[string]interface{}) error {
+	var keys []string
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case adv := <-advChannel:
-				if strings.EqualFold(adv.LocalName(), id) {
-					var s struct{}
-					devices[adv.Address().String()] = s
-				}
-			}
+	for _, key := range keys {
+		entry := key
+		if value := variables[key]; value != nil {
+			entry = fmt.Sprintf("%s=%v", key, value)
 		}
-	}()
 
-	err := ble.Scan(ctx, false, func(adv ble.Advertisement) { advChannel <- adv }, nil)
-	if errors.Cause(err) != context.DeadlineExceeded && errors.Cause(err) != context.Canceled {
-		return devices, err
+		if err := WriteCharacteristic(client, characteristic, []byte(entry), false); err != nil {
+			return err
+		}
 	}
 
-	return devices, nil
+	return nil
 }
 
-func Online(id string) (bool, error) {
-	online := false
-	advChannel := make(chan ble.Advertisement)
-	ctx, cancel := context.WithCancel(context.Background())
-	ctx = ble.WithSigHandler(context.WithTimeout(ctx, longTimeout))
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case adv := <-advChannel:
-				if strings.EqualFold(adv.Address().String(), id) {
-					online = true
-					cancel()
-				}
-			}
+// Toggle alternately writes the on and off values to the characteristic for the duration
+// The off value is always written last
+func Toggle(client ble.Client, characteristic *ble.Characteristic, on, off []byte, duration time.Duration) error {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if err := WriteCharacteristic(client, characteristic, on, false); err != nil {
+			return err
 		}
-	}()
+		time.Sleep(togglePeriod)
 
-	err := ble.Scan(ctx, false, func(adv ble.Advertisement) { advChannel <- adv }, nil)
-	if errors.Cause(err) != context.DeadlineExceeded && errors.Cause(err) != context.Canceled {
-		return online, err
+		if err := WriteCharacteristic(client, characteristic, off, false); err != nil {
+			return err
+		}
+		time.Sleep(togglePeriod)
 	}
 
-	return online, nil
+	return nil
+}
+
+// Scan returns the addresses of the devices advertising the name which have been seen by the presence tracker
+func Scan(id string) (map[string]struct{}, error) {
+	return presences.find(func(p presence) bool {
+		return strings.EqualFold(p.Name, id)
+	}, longTimeout, false), nil
+}
+
+// Online returns immediately if the presence tracker has seen the device recently
+// Otherwise it waits for the device to be seen
+func Online(id string) (bool, error) {
+	online := presences.find(func(p presence) bool {
+		return strings.EqualFold(p.Address, id)
+	}, longTimeout, true)
+
+	return len(online) > 0, nil
 }
 
 func GetName(id string) (string, error) {
@@ -207,6 +305,7 @@ func GetName(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer Close(client)
 
 	resp, err := ReadCharacteristic(client, name)
 	if err != nil {
@@ -267,6 +366,8 @@ func init() {
 		log.Fatal(err)
 	}
 
+	radio.OnStop(Stop)
+
 	log.Debug("Initialised bluetooth radio")
 }
 
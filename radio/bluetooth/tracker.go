@@ -0,0 +1,240 @@
+package bluetooth
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/currantlabs/ble"
+)
+
+// presence is the last advertisement seen from a device
+// Seen is measured on the scan clock, the total time the tracker has spent scanning, so that
+// devices are not aged out while scanning is paused for a connection
+type presence struct {
+	Address  string
+	Name     string
+	RSSI     int
+	LastSeen time.Time
+	Seen     time.Duration
+}
+
+// tracker continuously scans in the background, recording every device it sees
+// Scanning is paused while a connection is open as the controller can not do both reliably
+type tracker struct {
+	sync.Mutex
+	cond     *sync.Cond
+	table    map[string]presence
+	running  bool
+	stopping bool
+	scanning bool
+	paused   int
+	scanned  time.Duration
+	resumed  time.Time
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+const pollPeriod = 100 * time.Millisecond
+
+var presences = newTracker()
+
+func newTracker() *tracker {
+	t := &tracker{
+		table: make(map[string]presence),
+	}
+	t.cond = sync.NewCond(t)
+
+	return t
+}
+
+func (t *tracker) start() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.running {
+		return
+	}
+
+	// Start afresh as the table is stale after the tracker has been stopped
+	t.table = make(map[string]presence)
+	t.scanned = 0
+	t.running = true
+	t.stopping = false
+	t.done = make(chan struct{})
+	go t.track()
+
+	log.Debug("Started bluetooth presence tracker")
+}
+
+// stop stops the tracker and waits for scanning to finish, returning false if it was not running
+func (t *tracker) stop() bool {
+	t.Lock()
+	if !t.running {
+		t.Unlock()
+		return false
+	}
+
+	t.stopping = true
+	if t.scanning {
+		t.cancel()
+	}
+	t.cond.Broadcast()
+	done := t.done
+	t.Unlock()
+
+	<-done
+
+	t.Lock()
+	t.running = false
+	t.Unlock()
+
+	log.Debug("Stopped bluetooth presence tracker")
+
+	return true
+}
+
+func (t *tracker) isRunning() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.running
+}
+
+func (t *tracker) track() {
+	defer close(t.done)
+
+	for {
+		t.Lock()
+		for t.paused > 0 && !t.stopping {
+			t.cond.Wait()
+		}
+		if t.stopping {
+			t.Unlock()
+			return
+		}
+
+		var ctx context.Context
+		ctx, t.cancel = context.WithCancel(context.Background())
+		t.scanning = true
+		t.resumed = time.Now()
+		t.Unlock()
+
+		err := ble.Scan(ctx, true, t.see, nil)
+
+		t.Lock()
+		t.scanned += time.Now().Sub(t.resumed)
+		t.scanning = false
+		t.cancel()
+		t.cond.Broadcast()
+		t.Unlock()
+
+		if errors.Cause(err) != context.Canceled {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Warn("Bluetooth presence tracker scan failed")
+
+			time.Sleep(shortTimeout)
+		}
+	}
+}
+
+func (t *tracker) see(adv ble.Advertisement) {
+	t.Lock()
+	defer t.Unlock()
+
+	address := strings.ToLower(adv.Address().String())
+	p := t.table[address]
+	p.Address = address
+	p.RSSI = adv.RSSI()
+	p.LastSeen = time.Now()
+	p.Seen = t.clock()
+
+	// Scan responses and some advertisements do not carry the name so keep the last one seen
+	if name := adv.LocalName(); name != "" {
+		p.Name = name
+	}
+
+	t.table[address] = p
+}
+
+// pause stops scanning and waits for the scan to finish, each call must be matched by a call to resume
+func (t *tracker) pause() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.paused++
+	if t.scanning {
+		t.cancel()
+	}
+	for t.scanning {
+		t.cond.Wait()
+	}
+}
+
+func (t *tracker) resume() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.paused > 0 {
+		t.paused--
+	}
+	t.cond.Broadcast()
+}
+
+// forget removes a device from the table, it must be seen again before it is considered present
+// Used when connecting as devices stop advertising whilst connected and may restart
+func (t *tracker) forget(address string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.table, strings.ToLower(address))
+}
+
+// clock returns the total time spent scanning, the caller must hold the lock
+func (t *tracker) clock() time.Duration {
+	if t.scanning {
+		return t.scanned + time.Now().Sub(t.resumed)
+	}
+
+	return t.scanned
+}
+
+// find returns the addresses of the devices which match and have been seen within the last
+// window of scanning
+// If wait is set and nothing matches, it blocks until a device matches or the scan clock
+// has advanced by a full window
+// A full window of scanning is always waited for after the tracker starts so the table is complete
+// The wait is bounded in wall time in case scanning is paused by a connection which is never closed
+func (t *tracker) find(match func(presence) bool, window time.Duration, wait bool) map[string]struct{} {
+	deadline := time.Now().Add(2 * window)
+
+	t.Lock()
+	until := window
+	if wait {
+		until = t.clock() + window
+	}
+	t.Unlock()
+
+	for {
+		t.Lock()
+		now := t.clock()
+		found := make(map[string]struct{})
+		for address, p := range t.table {
+			if now-p.Seen <= window && match(p) {
+				found[address] = struct{}{}
+			}
+		}
+		t.Unlock()
+
+		if (wait && len(found) > 0) || now >= until || time.Now().After(deadline) {
+			return found
+		}
+
+		time.Sleep(pollPeriod)
+	}
+}
@@ -0,0 +1,68 @@
+package radio
+
+import (
+	"context"
+	"sync"
+)
+
+// Type defines the radio used to communicate with dependent devices
+type Type string
+
+const (
+	BLUETOOTH Type = "bluetooth"
+	WIFI           = "wifi"
+)
+
+var (
+	mutex    sync.Mutex
+	leases   = make(map[Type]chan struct{})
+	stoppers []func() error
+)
+
+// Acquire blocks until the radio is free or the context is cancelled
+// The returned function must be called to release the radio once finished with
+func Acquire(ctx context.Context, radio Type) (func(), error) {
+	lease := getLease(radio)
+
+	select {
+	case lease <- struct{}{}:
+		return func() { <-lease }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func getLease(radio Type) chan struct{} {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	lease, ok := leases[radio]
+	if !ok {
+		lease = make(chan struct{}, 1)
+		leases[radio] = lease
+	}
+
+	return lease
+}
+
+// OnStop registers a function which stops any background activity on a radio
+func OnStop(stop func() error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stoppers = append(stoppers, stop)
+}
+
+// Stop stops all background radio activity, freeing the radios for use by user code
+func Stop() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, stop := range stoppers {
+		if err := stop(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package wifi
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"github.com/grandcat/zeroconf"
 	"github.com/parnurzeal/gorequest"
 	"github.com/resin-io/edge-node-manager/config"
+	"github.com/resin-io/edge-node-manager/failure"
 )
 
 var (
@@ -24,6 +26,7 @@ type Host struct {
 	deviceType      string
 	applicationUUID string
 	id              string
+	version         string
 }
 
 func Initialise() error {
@@ -126,7 +129,24 @@ func GetIP(id string) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("Device offline")
+	return "", failure.Transientf("Device offline")
+}
+
+// GetVersion returns the firmware version the device advertises in its "version" TXT record,
+// or an empty string if the device does not advertise one
+func GetVersion(id string) (string, error) {
+	hosts, err := scan()
+	if err != nil {
+		return "", err
+	}
+
+	for _, host := range hosts {
+		if host.id == id {
+			return host.version, nil
+		}
+	}
+
+	return "", failure.Transientf("Device offline")
 }
 
 func PostForm(url, filePath string) error {
@@ -144,6 +164,40 @@ func PostForm(url, filePath string) error {
 	return handleResp(resp, errs, http.StatusOK)
 }
 
+func Post(url string) error {
+	req := gorequest.New()
+	req.Post(url)
+
+	log.WithFields(log.Fields{
+		"URL":    req.Url,
+		"Method": req.Method,
+	}).Info("Posting")
+
+	resp, _, errs := req.End()
+	return handleResp(resp, errs, http.StatusOK)
+}
+
+func PostJSON(url string, content interface{}) error {
+	bytes, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	req := gorequest.New()
+	req.Post(url)
+	req.Set("Content-Type", "application/json")
+	req.Send((string)(bytes))
+
+	log.WithFields(log.Fields{
+		"URL":    req.Url,
+		"Method": req.Method,
+		"Body":   (string)(bytes),
+	}).Info("Posting JSON")
+
+	resp, _, errs := req.End()
+	return handleResp(resp, errs, http.StatusOK)
+}
+
 func init() {
 	log.SetLevel(config.GetLogLevel())
 
@@ -182,6 +236,11 @@ func scan() ([]Host, error) {
 				applicationUUID: parts[1],
 				id:              parts[2],
 			}
+			for _, record := range entry.Text {
+				if strings.HasPrefix(record, "version=") {
+					host.version = strings.TrimPrefix(record, "version=")
+				}
+			}
 			*hosts = append(*hosts, host)
 		}
 	}(entries, &hosts)
@@ -201,11 +260,20 @@ func scan() ([]Host, error) {
 
 func handleResp(resp gorequest.Response, errs []error, statusCode int) error {
 	if errs != nil {
-		return errs[0]
+		return failure.Transient(errs[0])
 	}
 
 	if resp.StatusCode != statusCode {
-		return fmt.Errorf("Invalid response received: %s", resp.Status)
+		err := fmt.Errorf("Invalid response received: %s", resp.Status)
+		switch {
+		case resp.StatusCode >= http.StatusInternalServerError:
+			return failure.Transient(err)
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusRequestEntityTooLarge:
+			// The device does not support the request or the firmware is too big for it
+			return failure.Incompatible(err)
+		default:
+			return failure.Rejected(err)
+		}
 	}
 
 	log.WithFields(log.Fields{
@@ -1,8 +1,10 @@
 package supervisor
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -68,30 +70,29 @@ func DependentApplicationsList() ([]byte, []error) {
 	return body, nil
 }
 
-// DependentApplicationUpdate downloads the binary.tar for a specific application and target commit
-// Saving it to {ENM_ASSETS_DIRECTORY}/{applicationUUID}/{targetCommit}/binary.tar
-func DependentApplicationUpdate(applicationUUID int, targetCommit string) error {
+// DependentApplicationUpdate downloads the binary.tar for a specific application and target commit to the file path
+// A partially downloaded file is resumed, progress is called with the bytes received and the total size every second
+// Cancelling the context stops the download, leaving the partial file to be resumed later
+// The response header is returned so the download can be verified against any size and checksum it provides
+func DependentApplicationUpdate(ctx context.Context, applicationUUID int, targetCommit, filePath string, progress func(received, size int64)) (http.Header, error) {
 	url, err := buildPath(address, []string{version, "dependent-apps", strconv.Itoa(applicationUUID), "assets", targetCommit})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req, err := grab.NewRequest(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	q := req.HTTPRequest.URL.Query()
 	q.Set("apikey", rawKey)
 	req.HTTPRequest.URL.RawQuery = q.Encode()
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
 
-	filePath := config.GetAssetsDir()
-	filePath = path.Join(filePath, strconv.Itoa(applicationUUID))
-	filePath = path.Join(filePath, targetCommit)
-	if err = os.MkdirAll(filePath, os.ModePerm); err != nil {
-		return err
+	if err = os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		return nil, err
 	}
-	filePath = path.Join(filePath, "binary.tar")
 	req.Filename = filePath
 
 	log.WithFields(log.Fields{
@@ -102,19 +103,32 @@ func DependentApplicationUpdate(applicationUUID int, targetCommit string) error
 	}).Debug("Requesting dependent application update")
 
 	client := grab.NewClient()
-	resp, err := client.Do(req)
+	resp := <-client.DoAsync(req)
 
-	if err != nil {
-		return err
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for !resp.IsComplete() {
+		<-ticker.C
+		progress((int64)(resp.BytesTransferred()), (int64)(resp.Size))
+	}
+
+	if resp.Error != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, resp.Error
 	}
 
-	if resp.HTTPResponse.StatusCode != 200 {
-		return fmt.Errorf("Dependent application update failed")
+	if resp.HTTPResponse.StatusCode != http.StatusOK && resp.HTTPResponse.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("Dependent application update failed")
 	}
+	progress((int64)(resp.BytesTransferred()), (int64)(resp.Size))
 
-	log.Debug("Dependent application update succeeded")
+	log.WithFields(log.Fields{
+		"Resumed": resp.DidResume,
+	}).Debug("Dependent application update succeeded")
 
-	return nil
+	return resp.HTTPResponse.Header, nil
 }
 
 func DependentDeviceLog(UUID, message string) []error {